@@ -4,27 +4,102 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/arunvelsriram/sodexwoe/internal/constants"
 	"github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
 )
 
 type BillConfigs map[string]BillConfig
 
 type Config struct {
-	DownloadDir string      `yaml:"download_dir" binding:"required"`
-	BillConfigs BillConfigs `yaml:"bills"`
+	DownloadDir      string        `yaml:"download_dir" binding:"required"`
+	Timezone         string        `yaml:"timezone"`
+	Source           string        `yaml:"source"`
+	IMAP             IMAPConfig    `yaml:"imap"`
+	Local            LocalConfig   `yaml:"local"`
+	Outlook          OutlookConfig `yaml:"outlook"`
+	ProcessedLabel   string        `yaml:"processed_label"`
+	ArchiveProcessed bool          `yaml:"archive_processed"`
+	Email            string        `yaml:"email"`
+	TokenStore       string        `yaml:"token_store"`
+	Accounts         Accounts      `yaml:"accounts"`
+	CredentialsFile  string        `yaml:"credentials_file"`
+	BillConfigs      BillConfigs   `yaml:"bills"`
+}
+
+type Accounts map[string]AccountConfig
+
+// AccountConfig is a Google account having bills, which is signed in to
+// separately. Bills without an account are read from the default account.
+type AccountConfig struct {
+	// Email is suggested as the account to sign in to, and is impersonated
+	// when using a service account key.
+	Email string `yaml:"email"`
+}
+
+type IMAPConfig struct {
+	Address   string `yaml:"address"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	Plaintext bool   `yaml:"plaintext"`
+}
+
+// LocalConfig configures reading emails from a local mail export.
+type LocalConfig struct {
+	Path string `yaml:"path"`
+}
+
+// OutlookConfig configures reading emails from a Microsoft 365 mailbox using
+// the Microsoft Graph API.
+type OutlookConfig struct {
+	ClientId string `yaml:"client_id"`
+	// Tenant defaults to common, allowing both work and personal accounts.
+	Tenant string `yaml:"tenant"`
 }
 
 type BillConfig struct {
-	Type           string `yaml:"type" binding:"required"`
-	Label          string `yaml:"label" binding:"required"`
-	KeepPages      int    `yaml:"keep_pages"`
-	Password       string `yaml:"password"`
-	AdditionalText string `yaml:"additional_text"`
+	Type           string   `yaml:"type" binding:"required"`
+	Label          string   `yaml:"label"`
+	KeepPages      int      `yaml:"keep_pages"`
+	Password       string   `yaml:"password"`
+	AdditionalText string   `yaml:"additional_text"`
+	From           string   `yaml:"from"`
+	Subject        string   `yaml:"subject"`
+	HasAttachment  bool     `yaml:"has_attachment"`
+	Query          []string `yaml:"query"`
+	PeriodOffset   int      `yaml:"period_offset"`
+	Folder         string   `yaml:"folder"`
+	Category       string   `yaml:"category"`
+	// InvoicePattern is a regular expression matching the invoice number in
+	// the text of the bill, captured by its first group when it has one.
+	InvoicePattern string `yaml:"invoice_pattern"`
+	// Account is the name of the Google account having the bill.
+	Account string `yaml:"account"`
+}
+
+// HasRules reports whether the bill is matched using sender/subject query
+// rules instead of only a Gmail label.
+func (b BillConfig) HasRules() bool {
+	return b.From != "" || b.Subject != "" || b.HasAttachment || len(b.Query) > 0
+}
+
+// IsLabelBased reports whether the bill is found using only its Gmail label,
+// which is required to sync it using the Gmail history.
+func (b BillConfig) IsLabelBased() bool {
+	return !b.HasRules() && b.Label != ""
+}
+
+func (c Config) Bill(billName string) (BillConfig, error) {
+	for name, bill := range c.BillConfigs {
+		if strings.EqualFold(billName, name) {
+			return bill, nil
+		}
+	}
+	return BillConfig{}, fmt.Errorf("could not find bill config for bill name: %v", billName)
 }
 
 func (c Config) Label(billName string) (string, error) {
@@ -50,11 +125,92 @@ func (c Config) Labels(billNames []string) ([]string, error) {
 	return labels, nil
 }
 
+// Account returns the config of a named Google account, or of the default
+// account when the name is empty.
+func (c Config) Account(name string) (AccountConfig, error) {
+	if name == "" {
+		return AccountConfig{Email: c.Email}, nil
+	}
+	account, ok := c.Accounts[name]
+	if !ok {
+		return AccountConfig{}, fmt.Errorf("could not find account config for account name: %v", name)
+	}
+	return account, nil
+}
+
+// BillNamesByAccount groups the bill names by the name of their Google
+// account, which is empty for the default account.
+func (c Config) BillNamesByAccount(billNames []string) (map[string][]string, error) {
+	result := make(map[string][]string)
+	for _, billName := range billNames {
+		bill, err := c.Bill(billName)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.Account(bill.Account); err != nil {
+			return nil, fmt.Errorf("%v, bill: %v", err, billName)
+		}
+		result[bill.Account] = append(result[bill.Account], billName)
+	}
+
+	return result, nil
+}
+
+// MailSource returns the configured mail source, defaulting to Gmail.
+func (c Config) MailSource() string {
+	if c.Source == "" {
+		return constants.SOURCE_GMAIL
+	}
+	return strings.ToLower(c.Source)
+}
+
+// Mailbox identifies where the emails of the bill are read from, which is the
+// mail source along with the Google account of the bill when reading from
+// Gmail.
+func (c Config) Mailbox(billName string) string {
+	account := c.BillConfigs[billName].Account
+	if c.MailSource() != constants.SOURCE_GMAIL || account == "" {
+		return c.MailSource()
+	}
+	return c.MailSource() + "/" + account
+}
+
+// TokenStoreKind returns where the tokens are saved, defaulting to a plaintext
+// file.
+func (c Config) TokenStoreKind() string {
+	if c.TokenStore == "" {
+		return constants.TOKEN_STORE_FILE
+	}
+	return strings.ToLower(c.TokenStore)
+}
+
+// MarkProcessed reports whether converted bill emails should be labelled in
+// Gmail, which needs permission to modify emails. Emails read from the other
+// sources are never marked.
+func (c Config) MarkProcessed() bool {
+	return c.MailSource() == constants.SOURCE_GMAIL && c.ProcessedLabel != ""
+}
+
+// Location returns the configured timezone, defaulting to the local timezone.
+func (c Config) Location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %v: %v", c.Timezone, err)
+	}
+	return loc, nil
+}
+
+// BillNames returns the names of the configured bills, sorted.
 func (c Config) BillNames() []string {
 	names := make([]string, 0, len(c.BillConfigs))
 	for name := range c.BillConfigs {
 		names = append(names, name)
 	}
+	sort.Strings(names)
 
 	return names
 }
@@ -68,18 +224,61 @@ func ConfigPath() (string, error) {
 	return filepath.Join(homeDir, constants.DEFAULT_CONFIG_FILE), nil
 }
 
+// CachePath returns the cache directory of the Google account, which is empty
+// for the default account.
+func CachePath(account string) (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	if account == "" {
+		return filepath.Join(homeDir, constants.CACHE_DIR), nil
+	}
+	return filepath.Join(homeDir, fmt.Sprintf(constants.ACCOUNT_CACHE_DIR, account)), nil
+}
+
+// SyncStatePath returns the path of the sync state of the Google account,
+// which is empty for the default account.
+func SyncStatePath(account string) (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	if account == "" {
+		return filepath.Join(homeDir, constants.SYNC_STATE_FILE), nil
+	}
+	return filepath.Join(homeDir, fmt.Sprintf(constants.ACCOUNT_SYNC_STATE_FILE, account)), nil
+}
+
+func ClaimedBillsPath() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, constants.CLAIMED_BILLS_FILE), nil
+}
+
 func LoadConfig() (config Config, err error) {
 	configPath, err := ConfigPath()
 	if err != nil {
 		return config, err
 	}
 
+	return LoadConfigFile(configPath)
+}
+
+// LoadConfigFile loads the config file at the path strictly. The error is
+// Problems when the config is invalid.
+func LoadConfigFile(configPath string) (config Config, err error) {
 	file, err := os.ReadFile(configPath)
 	if err != nil {
 		return config, err
 	}
 
-	err = yaml.Unmarshal(file, &config)
+	config, err = Parse(file)
 	if err != nil {
 		return config, err
 	}
@@ -90,6 +289,18 @@ func LoadConfig() (config Config, err error) {
 	}
 	config.DownloadDir = downloadDir
 
+	var credentialsFile string
+	if credentialsFile, err = homedir.Expand(config.CredentialsFile); err != nil {
+		return config, err
+	}
+	config.CredentialsFile = credentialsFile
+
+	var localPath string
+	if localPath, err = homedir.Expand(config.Local.Path); err != nil {
+		return config, err
+	}
+	config.Local.Path = localPath
+
 	return config, err
 }
 
@@ -0,0 +1,225 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	yamlErrorPattern    = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	unknownFieldPattern = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+)
+
+// Problem is a problem in the config file, at the line of the key having it
+// when known.
+type Problem struct {
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+// Problems are all the problems found in an invalid config file.
+type Problems []Problem
+
+func (p Problems) Error() string {
+	lines := make([]string, 0, len(p))
+	for _, problem := range p {
+		lines = append(lines, problem.String())
+	}
+	return fmt.Sprintf("invalid config:\n%v", strings.Join(lines, "\n"))
+}
+
+// Parse decodes the content of a config file, failing on unknown keys and
+// values of the wrong type, and validates it. The error is Problems when the
+// config is invalid.
+func Parse(content []byte) (Config, error) {
+	var config Config
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return config, Problems{yamlProblem(err.Error())}
+	}
+
+	problems := make(Problems, 0)
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return config, Problems{yamlProblem(err.Error())}
+		}
+		for _, message := range typeErr.Errors {
+			problems = append(problems, yamlProblem(message))
+		}
+	}
+	problems = append(problems, requiredProblems(&root, reflect.ValueOf(config), nil)...)
+	problems = append(problems, config.problems(&root)...)
+	if len(problems) > 0 {
+		sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+		return config, problems
+	}
+
+	return config, nil
+}
+
+// yamlProblem returns the problem of an error message of the YAML decoder,
+// which starts with its line.
+func yamlProblem(message string) Problem {
+	match := yamlErrorPattern.FindStringSubmatch(message)
+	if match == nil {
+		return Problem{Message: message}
+	}
+	line, _ := strconv.Atoi(match[1])
+	message = match[2]
+	if field := unknownFieldPattern.FindStringSubmatch(message); field != nil {
+		message = fmt.Sprintf("unknown key: %v", field[1])
+	}
+	return Problem{Line: line, Message: message}
+}
+
+// requiredProblems reports the fields tagged `binding:"required"` having no
+// value, at the line of the mapping missing them.
+func requiredProblems(root *yaml.Node, v reflect.Value, path []string) Problems {
+	problems := make(Problems, 0)
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			fieldPath := append(append([]string{}, path...), key)
+			if field.Tag.Get("binding") == "required" && v.Field(i).IsZero() {
+				problems = append(problems, Problem{lineOf(root, path...), fmt.Sprintf("%v is required", strings.Join(fieldPath, "."))})
+			}
+			problems = append(problems, requiredProblems(root, v.Field(i), fieldPath)...)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			problems = append(problems, requiredProblems(root, v.MapIndex(key), append(append([]string{}, path...), key.String()))...)
+		}
+	}
+	return problems
+}
+
+// accountNamePattern matches the account names, which are used in the names of
+// the files of the accounts.
+var accountNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// problems reports the values that are not supported.
+func (c Config) problems(root *yaml.Node) Problems {
+	problems := make(Problems, 0)
+	switch c.MailSource() {
+	case constants.SOURCE_GMAIL, constants.SOURCE_EML, constants.SOURCE_MBOX, constants.SOURCE_MAILDIR:
+	case constants.SOURCE_IMAP:
+		if c.IMAP.Address == "" {
+			problems = append(problems, Problem{lineOf(root, "source"), "imap.address is required when source is imap"})
+		}
+	case constants.SOURCE_OUTLOOK:
+		if c.Outlook.ClientId == "" {
+			problems = append(problems, Problem{lineOf(root, "source"), "outlook.client_id is required when source is outlook"})
+		}
+	default:
+		problems = append(problems, Problem{lineOf(root, "source"), fmt.Sprintf("unsupported source: %v", c.Source)})
+	}
+	switch c.MailSource() {
+	case constants.SOURCE_EML, constants.SOURCE_MBOX, constants.SOURCE_MAILDIR:
+		if c.Local.Path == "" {
+			problems = append(problems, Problem{lineOf(root, "source"), fmt.Sprintf("local.path is required when source is %v", c.MailSource())})
+		}
+	}
+	if c.MailSource() != constants.SOURCE_GMAIL {
+		if c.ProcessedLabel != "" {
+			problems = append(problems, Problem{lineOf(root, "processed_label"), fmt.Sprintf("processed_label is supported only when source is gmail, not %v", c.MailSource())})
+		}
+		if c.ArchiveProcessed {
+			problems = append(problems, Problem{lineOf(root, "archive_processed"), fmt.Sprintf("archive_processed is supported only when source is gmail, not %v", c.MailSource())})
+		}
+	}
+	switch c.TokenStoreKind() {
+	case constants.TOKEN_STORE_FILE, constants.TOKEN_STORE_ENCRYPTED_FILE, constants.TOKEN_STORE_KEYRING:
+	default:
+		problems = append(problems, Problem{lineOf(root, "token_store"), fmt.Sprintf("unsupported token_store: %v", c.TokenStore)})
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		problems = append(problems, Problem{lineOf(root, "timezone"), fmt.Sprintf("invalid timezone: %v", c.Timezone)})
+	}
+
+	accountNames := make([]string, 0, len(c.Accounts))
+	for name := range c.Accounts {
+		accountNames = append(accountNames, name)
+	}
+	sort.Strings(accountNames)
+	for _, name := range accountNames {
+		if !accountNamePattern.MatchString(name) {
+			problems = append(problems, Problem{lineOf(root, "accounts", name), fmt.Sprintf("accounts.%v should be named using only lowercase letters, digits, _ and -", name)})
+		}
+	}
+
+	billNames := make([]string, 0, len(c.BillConfigs))
+	for name := range c.BillConfigs {
+		billNames = append(billNames, name)
+	}
+	sort.Strings(billNames)
+	for _, name := range billNames {
+		bill := c.BillConfigs[name]
+		if _, ok := c.Accounts[bill.Account]; bill.Account != "" && !ok {
+			problems = append(problems, Problem{lineOf(root, "bills", name, "account"), fmt.Sprintf("bills.%v.account is not under accounts: %v", name, bill.Account)})
+		}
+		if bill.KeepPages < 0 {
+			problems = append(problems, Problem{lineOf(root, "bills", name, "keep_pages"), fmt.Sprintf("bills.%v.keep_pages cannot be negative: %d", name, bill.KeepPages)})
+		}
+		if _, err := regexp.Compile(bill.InvoicePattern); err != nil {
+			problems = append(problems, Problem{lineOf(root, "bills", name, "invoice_pattern"), fmt.Sprintf("bills.%v.invoice_pattern is invalid: %v", name, err)})
+		}
+		if c.MailSource() == constants.SOURCE_GMAIL && bill.Label == "" && !bill.HasRules() {
+			problems = append(problems, Problem{lineOf(root, "bills", name), fmt.Sprintf("bills.%v needs a label or query rules to find its emails in gmail", name)})
+		}
+	}
+	return problems
+}
+
+// lineOf returns the line of the key at the path in the document, or of the
+// deepest key found along the path, which is 0 when none is found.
+func lineOf(root *yaml.Node, path ...string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line := 0
+	for _, key := range path {
+		if node.Kind != yaml.MappingNode {
+			break
+		}
+		found := false
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				line = node.Content[i].Line
+				node = node.Content[i+1]
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return line
+}
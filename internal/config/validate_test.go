@@ -0,0 +1,127 @@
+package config_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSampleConfig(t *testing.T) {
+	content, err := os.ReadFile("../../config.sample.yaml")
+	require.NoError(t, err)
+
+	cfg, err := config.Parse(content)
+
+	require.NoError(t, err)
+	assert.Equal(t, "airtel_postpaid", cfg.BillConfigs["personal"].Type)
+	assert.Equal(t, "office", cfg.BillConfigs["work"].Account)
+}
+
+func TestParseReportsEveryProblem(t *testing.T) {
+	content := []byte(`bills:
+  personal:
+    typ: airtel_postpaid
+    keep_pages: four
+    label: Postpaid Bills/Airtel
+  work:
+    type: jio_postpaid
+    keep_pages: -1
+    account: office
+    invoice_pattern: 'Invoice No: ('
+source: pop3
+timezone: Mars/Olympus
+`)
+
+	_, err := config.Parse(content)
+
+	var problems config.Problems
+	require.ErrorAs(t, err, &problems)
+	assert.Equal(t, config.Problems{
+		{Line: 0, Message: "download_dir is required"},
+		{Line: 2, Message: "bills.personal.type is required"},
+		{Line: 3, Message: "unknown key: typ"},
+		{Line: 4, Message: "cannot unmarshal !!str `four` into int"},
+		{Line: 8, Message: "bills.work.keep_pages cannot be negative: -1"},
+		{Line: 9, Message: "bills.work.account is not under accounts: office"},
+		{Line: 10, Message: "bills.work.invoice_pattern is invalid: error parsing regexp: missing closing ): `Invoice No: (`"},
+		{Line: 11, Message: "unsupported source: pop3"},
+		{Line: 12, Message: "invalid timezone: Mars/Olympus"},
+	}, problems)
+}
+
+func TestParseReportsGmailBillWithoutLabel(t *testing.T) {
+	content := []byte(`download_dir: ~/Downloads/sodexwoe
+bills:
+  personal:
+    type: airtel_postpaid
+    label: Postpaid Bills/Airtel
+  work:
+    type: jio_postpaid
+  broadband:
+    type: act
+    from: ebill@actcorp.in
+`)
+
+	_, err := config.Parse(content)
+
+	var problems config.Problems
+	require.ErrorAs(t, err, &problems)
+	assert.Equal(t, config.Problems{{Line: 6, Message: "bills.work needs a label or query rules to find its emails in gmail"}}, problems)
+}
+
+func TestParseReportsProcessedWithoutGmail(t *testing.T) {
+	content := []byte(`download_dir: ~/Downloads/sodexwoe
+processed_label: sodexwoe/processed
+archive_processed: true
+source: imap
+imap:
+  address: imap.example.com:993
+bills:
+  personal:
+    type: airtel_postpaid
+    folder: Bills/Airtel
+`)
+
+	_, err := config.Parse(content)
+
+	var problems config.Problems
+	require.ErrorAs(t, err, &problems)
+	assert.Equal(t, config.Problems{
+		{Line: 2, Message: "processed_label is supported only when source is gmail, not imap"},
+		{Line: 3, Message: "archive_processed is supported only when source is gmail, not imap"},
+	}, problems)
+}
+
+func TestParseReportsInvalidAccountName(t *testing.T) {
+	content := []byte(`download_dir: ~/Downloads/sodexwoe
+accounts:
+  office:
+    email: me@office.com
+  ../work:
+    email: me@work.com
+  Home Mail: {}
+bills:
+  personal:
+    type: airtel_postpaid
+    label: Postpaid Bills/Airtel
+    account: office
+`)
+
+	_, err := config.Parse(content)
+
+	var problems config.Problems
+	require.ErrorAs(t, err, &problems)
+	assert.Equal(t, config.Problems{
+		{Line: 5, Message: "accounts.../work should be named using only lowercase letters, digits, _ and -"},
+		{Line: 7, Message: "accounts.Home Mail should be named using only lowercase letters, digits, _ and -"},
+	}, problems)
+}
+
+func TestParseReportsSyntaxError(t *testing.T) {
+	_, err := config.Parse([]byte("download_dir: ~/Downloads\nbills:\n  personal: [\n"))
+
+	assert.EqualError(t, err, "invalid config:\nline 3: did not find expected node content")
+}
@@ -1,8 +1,31 @@
 package constants
 
 const (
-	SODEXWOE_DIR        = ".config/sodexwoe/"
-	DEFAULT_CONFIG_FILE = SODEXWOE_DIR + "config.yaml"
-	GOOGLE_TOKEN_FILE   = SODEXWOE_DIR + "token.json"
-	GMAIL_USER          = "me"
+	SODEXWOE_DIR              = ".config/sodexwoe/"
+	DEFAULT_CONFIG_FILE       = SODEXWOE_DIR + "config.yaml"
+	GOOGLE_TOKEN_FILE         = SODEXWOE_DIR + "token.json"
+	GOOGLE_ACCOUNT_TOKEN_FILE = SODEXWOE_DIR + "token-%s.json"
+	OUTLOOK_TOKEN_FILE        = SODEXWOE_DIR + "outlook_token.json"
+	CACHE_DIR                 = SODEXWOE_DIR + "cache"
+	ACCOUNT_CACHE_DIR         = SODEXWOE_DIR + "cache-%s"
+	SYNC_STATE_FILE           = SODEXWOE_DIR + "sync.json"
+	ACCOUNT_SYNC_STATE_FILE   = SODEXWOE_DIR + "sync-%s.json"
+	CLAIMED_BILLS_FILE        = SODEXWOE_DIR + "claimed.json"
+	GMAIL_USER                = "me"
+	GRAPH_API_URL             = "https://graph.microsoft.com/v1.0"
+)
+
+const (
+	SOURCE_GMAIL   = "gmail"
+	SOURCE_IMAP    = "imap"
+	SOURCE_EML     = "eml"
+	SOURCE_MBOX    = "mbox"
+	SOURCE_MAILDIR = "maildir"
+	SOURCE_OUTLOOK = "outlook"
+)
+
+const (
+	TOKEN_STORE_FILE           = "file"
+	TOKEN_STORE_ENCRYPTED_FILE = "encrypted_file"
+	TOKEN_STORE_KEYRING        = "keyring"
 )
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// AuthStatus describes the saved token of the signed in Google account.
+type AuthStatus struct {
+	Email         string
+	Scopes        []string
+	Expiry        time.Time
+	TokenLocation string
+}
@@ -0,0 +1,60 @@
+package models
+
+import "strings"
+
+type BillChecks []BillCheck
+
+// BillCheck is what was found for a bill for a billed month, in the mailbox
+// and in the download dir.
+type BillCheck struct {
+	BillName string
+	// MessageIds are of the emails having the bill.
+	MessageIds []string
+	// Files are the converted bills in the download dir.
+	Files []string
+	// Unconverted are the message ids of the emails whose bill is not in the
+	// download dir.
+	Unconverted []string
+}
+
+// Missing reports whether the bill was found neither in the mailbox nor in
+// the download dir.
+func (c BillCheck) Missing() bool {
+	return len(c.MessageIds) == 0 && len(c.Files) == 0
+}
+
+// Duplicated reports whether more than one bill was found.
+func (c BillCheck) Duplicated() bool {
+	return len(c.MessageIds) > 1 || len(c.Files) > 1
+}
+
+// Status describes the problems found with the bill, or ok when there are
+// none.
+func (c BillCheck) Status() string {
+	if c.Missing() {
+		return "missing"
+	}
+
+	problems := make([]string, 0, 2)
+	if c.Duplicated() {
+		problems = append(problems, "duplicated")
+	}
+	if len(c.Unconverted) > 0 {
+		problems = append(problems, "unconverted")
+	}
+	if len(problems) == 0 {
+		return "ok"
+	}
+	return strings.Join(problems, ", ")
+}
+
+// Missing returns the names of the missing bills.
+func (cs BillChecks) Missing() []string {
+	billNames := make([]string, 0)
+	for _, c := range cs {
+		if c.Missing() {
+			billNames = append(billNames, c.BillName)
+		}
+	}
+	return billNames
+}
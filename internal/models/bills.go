@@ -1,19 +1,57 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
 	"time"
 )
 
 type BillEmails []BillEmail
 
+// BillEmail is a bill found in an email. Year and Month are of the billed
+// period, which could be different from when the email was received.
 type BillEmail struct {
-	BillName string
-	Year     int
-	Month    time.Month
-	Bill     Bill
+	MessageId string
+	BillName  string
+	Year      int
+	Month     time.Month
+	Bill      Bill
+}
+
+// BillDir returns the directory of the converted bills of a bill for the
+// billed month, under the download dir.
+func BillDir(downloadDir, billName string, year int, month time.Month) string {
+	return filepath.Join(downloadDir, fmt.Sprintf("%d-%02d", year, month), billName)
+}
+
+// OutputPath returns where the converted bill of the email is written.
+func (e BillEmail) OutputPath(downloadDir string) string {
+	filename := fmt.Sprintf("%s_%s_%d--%s", e.BillName, e.Month.String(), e.Year, filepath.Base(e.Bill.Filename))
+	return filepath.Join(BillDir(downloadDir, e.BillName, e.Year, e.Month), filename)
 }
 
 type Bill struct {
 	Filename string
 	Data     []byte
+	// InvoiceNumber is found in the bill only when the bill has an invoice
+	// pattern.
+	InvoiceNumber string
+}
+
+// Hash returns the SHA-256 hash of the bill content, identifying copies of
+// the same bill.
+func (b Bill) Hash() string {
+	sum := sha256.Sum256(b.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+type SkippedEmails []SkippedEmail
+
+// SkippedEmail is an email that was skipped instead of failing the run.
+type SkippedEmail struct {
+	MessageId string
+	BillName  string
+	Reason    string
 }
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// CachedMessage is a Gmail message along with the content hashes of its
+// cached attachments by attachment id.
+type CachedMessage struct {
+	Message     *gmail.Message    `json:"message"`
+	Attachments map[string]string `json:"attachments"`
+}
+
+type CacheEntries []CacheEntry
+
+type CacheEntry struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+func (e CacheEntry) IsAttachment() bool {
+	return strings.HasPrefix(e.Key, "attachments/")
+}
+
+// Hash returns the content hash of a cached attachment.
+func (e CacheEntry) Hash() string {
+	return path.Base(e.Key)
+}
+
+func (entries CacheEntries) Size() int64 {
+	var size int64
+	for _, it := range entries {
+		size += it.Size
+	}
+
+	return size
+}
@@ -0,0 +1,57 @@
+package models
+
+import "time"
+
+type ClaimedBills []ClaimedBill
+
+// ClaimedBill is a converted bill, recorded so that copies of it received
+// later are not claimed again.
+type ClaimedBill struct {
+	// Mailbox is where the email was read from, as message ids are unique
+	// only within a mailbox. It is empty for bills claimed before it was
+	// recorded.
+	Mailbox       string     `json:"mailbox,omitempty"`
+	MessageId     string     `json:"message_id"`
+	BillName      string     `json:"bill_name"`
+	Year          int        `json:"year"`
+	Month         time.Month `json:"month"`
+	Hash          string     `json:"hash"`
+	InvoiceNumber string     `json:"invoice_number,omitempty"`
+	ClaimedAt     time.Time  `json:"claimed_at"`
+}
+
+// ClaimedFrom reports whether the bill was claimed from the email of the
+// mailbox. Bills claimed without a mailbox are taken to be from any mailbox.
+func (c ClaimedBill) ClaimedFrom(mailbox, messageId string) bool {
+	return c.MessageId == messageId && (c.Mailbox == "" || c.Mailbox == mailbox)
+}
+
+// Matches reports whether the email of the mailbox has a copy of the claimed
+// bill, having the same content or invoice number.
+func (c ClaimedBill) Matches(mailbox string, email BillEmail) bool {
+	if c.BillName != email.BillName || c.ClaimedFrom(mailbox, email.MessageId) {
+		return false
+	}
+	return c.Hash == email.Bill.Hash() || (c.InvoiceNumber != "" && c.InvoiceNumber == email.Bill.InvoiceNumber)
+}
+
+// Find returns the claimed bill the email of the mailbox has a copy of.
+func (cs ClaimedBills) Find(mailbox string, email BillEmail) (ClaimedBill, bool) {
+	for _, c := range cs {
+		if c.Matches(mailbox, email) {
+			return c, true
+		}
+	}
+	return ClaimedBill{}, false
+}
+
+// IndexOf returns the index of the bill claimed from the email of the mailbox,
+// or -1 when none is.
+func (cs ClaimedBills) IndexOf(mailbox, messageId string) int {
+	for i, c := range cs {
+		if c.ClaimedFrom(mailbox, messageId) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,14 @@
+package models
+
+type GmailSetupResults []GmailSetupResult
+
+// GmailSetupResult is what was set up in Gmail for a bill.
+type GmailSetupResult struct {
+	BillName       string
+	Label          string
+	LabelCreated   bool
+	FilterCreated  bool
+	LabelledEmails int
+	// Note explains what could not be set up for the bill.
+	Note string
+}
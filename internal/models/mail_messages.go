@@ -0,0 +1,32 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// MailMessage is an email read from a mail source, without the content of
+// its attachments.
+type MailMessage struct {
+	Id          string
+	From        string
+	Subject     string
+	Received    time.Time
+	Attachments []Attachment
+}
+
+type Attachment struct {
+	Id       string
+	Filename string
+}
+
+// PDFAttachment returns the first attachment that is a PDF file.
+func (m MailMessage) PDFAttachment() (Attachment, bool) {
+	for _, it := range m.Attachments {
+		if it.Filename != "" && strings.Contains(strings.ToLower(it.Filename), ".pdf") {
+			return it, true
+		}
+	}
+
+	return Attachment{}, false
+}
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// SyncState is the Gmail history id up to which each bill has been synced, by
+// bill name.
+type SyncState struct {
+	HistoryIds map[string]uint64 `json:"history_ids"`
+	SyncedAt   time.Time         `json:"synced_at"`
+}
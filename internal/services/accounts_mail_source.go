@@ -0,0 +1,110 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// accountsMailSource reads the bills of each account from the mail source of
+// the account, merging the emails found.
+type accountsMailSource struct {
+	sources map[string]MailSource
+	cfg     config.Config
+	// messageAccounts are the accounts of the emails found by id.
+	messageAccounts map[string]string
+}
+
+func (s accountsMailSource) Search(billName string, period utils.Period) ([]string, error) {
+	billConfig, err := s.cfg.Bill(billName)
+	if err != nil {
+		return nil, err
+	}
+	source, ok := s.sources[billConfig.Account]
+	if !ok {
+		return nil, fmt.Errorf("no mail source for account: %v, bill: %v", billConfig.Account, billName)
+	}
+
+	log.WithField("billName", billName).WithField("account", billConfig.Account).Debug("searching emails of account")
+	messageIds, err := source.Search(billName, period)
+	if err != nil {
+		return nil, err
+	}
+	for _, messageId := range messageIds {
+		s.messageAccounts[messageId] = billConfig.Account
+	}
+	return messageIds, nil
+}
+
+func (s accountsMailSource) Message(id string) (models.MailMessage, error) {
+	account, err := s.messageAccount(id)
+	if err != nil {
+		return models.MailMessage{}, err
+	}
+	return s.sources[account].Message(id)
+}
+
+func (s accountsMailSource) Attachment(message models.MailMessage, attachment models.Attachment) ([]byte, error) {
+	account, err := s.messageAccount(message.Id)
+	if err != nil {
+		return nil, err
+	}
+	return s.sources[account].Attachment(message, attachment)
+}
+
+// MarkProcessed marks the emails as processed in the mail source of their
+// account.
+func (s accountsMailSource) MarkProcessed(messageIds []string) error {
+	byAccount := make(map[string][]string)
+	for _, messageId := range messageIds {
+		account, err := s.messageAccount(messageId)
+		if err != nil {
+			return err
+		}
+		byAccount[account] = append(byAccount[account], messageId)
+	}
+
+	for account, ids := range byAccount {
+		marker, ok := s.sources[account].(ProcessedMarker)
+		if !ok {
+			return errors.New("mail source does not support marking emails as processed")
+		}
+		if err := marker.MarkProcessed(ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the mail sources of the accounts.
+func (s accountsMailSource) Close() error {
+	var result error
+	for _, source := range s.sources {
+		if closer, ok := source.(io.Closer); ok {
+			if err := closer.Close(); err != nil && result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
+
+func (s accountsMailSource) messageAccount(id string) (string, error) {
+	account, ok := s.messageAccounts[id]
+	if !ok {
+		return "", fmt.Errorf("email not found by any account search, messageId: %v", id)
+	}
+	return account, nil
+}
+
+// NewAccountsMailSource creates a mail source reading the bills of each
+// account, by account name, from the mail source of the account. It does not
+// support sync.
+func NewAccountsMailSource(sources map[string]MailSource, cfg config.Config) MailSource {
+	return accountsMailSource{sources, cfg, make(map[string]string)}
+}
@@ -0,0 +1,239 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/browser"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// signInTimeout is how long to wait for the user to sign in using a browser.
+const signInTimeout = 5 * time.Minute
+
+var errSignInDenied = errors.New("sign in was denied, access to the mailbox was not allowed")
+
+// authCodeRequest is an OAuth 2.0 authorization code request using a random
+// state and a PKCE (RFC 7636) code verifier.
+type authCodeRequest struct {
+	config   *oauth2.Config
+	state    string
+	verifier string
+	opts     []oauth2.AuthCodeOption
+}
+
+func newAuthCodeRequest(config *oauth2.Config, opts ...oauth2.AuthCodeOption) (authCodeRequest, error) {
+	state, err := randomToken()
+	if err != nil {
+		return authCodeRequest{}, err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return authCodeRequest{}, err
+	}
+
+	return authCodeRequest{config, state, verifier, opts}, nil
+}
+
+func (r authCodeRequest) authURL() string {
+	challenge := sha256.Sum256([]byte(r.verifier))
+	// Forcing the consent screen makes sure a refresh token is issued even
+	// when the app was allowed access before.
+	opts := append([]oauth2.AuthCodeOption{
+		oauth2.AccessTypeOffline,
+		oauth2.ApprovalForce,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}, r.opts...)
+	return r.config.AuthCodeURL(r.state, opts...)
+}
+
+// authCode returns the code in the query of the redirect URL, after verifying
+// the state.
+func (r authCodeRequest) authCode(q url.Values) (string, error) {
+	if q.Has("error") {
+		if q.Get("error") == "access_denied" {
+			return "", errSignInDenied
+		}
+		return "", fmt.Errorf("sign in failed: %v: %v", q.Get("error"), q.Get("error_description"))
+	}
+	if q.Get("state") != r.state {
+		return "", errors.New("sign in failed: state in the redirect URL does not match the request")
+	}
+	if q.Get("code") == "" {
+		return "", errors.New("sign in failed: no code in the redirect URL")
+	}
+
+	return q.Get("code"), nil
+}
+
+func (r authCodeRequest) exchange(ctx context.Context, authCode string) (*oauth2.Token, error) {
+	return r.config.Exchange(ctx, authCode, oauth2.SetAuthURLParam("code_verifier", r.verifier))
+}
+
+// randomToken returns 32 random bytes encoded as URL-safe base64, usable as
+// the state and the PKCE code verifier.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Request a token from the web, then returns the retrieved token. The code is
+// received on a loopback redirect URL of an ephemeral port.
+func getTokenFromWeb(config *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start server: %v", err)
+	}
+	webConfig := *config
+	webConfig.RedirectURL = fmt.Sprintf("http://%v/callback", listener.Addr())
+	req, err := newAuthCodeRequest(&webConfig, opts...)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	authURL := req.authURL()
+	log.Infof("Opening Auth URL: %v", authURL)
+	if err := browser.OpenURL(authURL); err != nil {
+		log.WithField("authURL", authURL).Debug("failed to open URL in browser")
+		listener.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), signInTimeout)
+	defer cancel()
+	authCode, err := getAuthCode(ctx, listener, req)
+	if err != nil {
+		log.Debugf("unable to get authCode")
+		return nil, err
+	}
+
+	tok, err := req.exchange(ctx, authCode)
+	if err != nil {
+		log.Debugf("Unable to retrieve token from web")
+		return nil, err
+	}
+
+	return tok, nil
+}
+
+// getAuthCode serves the redirect URL on the listener until the first
+// callback, or until the context is done.
+func getAuthCode(ctx context.Context, listener net.Listener, req authCodeRequest) (string, error) {
+	type authCodeResponseHolder struct {
+		authCode string
+		err      error
+	}
+	ch := make(chan authCodeResponseHolder, 1)
+	respond := func(res authCodeResponseHolder) {
+		select {
+		case ch <- res:
+		default:
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	})
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("got callback")
+		authCode, err := req.authCode(r.URL.Query())
+		if errors.Is(err, errSignInDenied) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Sign in was denied, so sodexwoe cannot read your bills. You may close this tab and run the command again to allow access."))
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v. You may close this tab and run the command again.", err)
+		} else {
+			w.Write([]byte("Signed in, you may close this tab now!"))
+		}
+		respond(authCodeResponseHolder{authCode, err})
+	})
+	server := http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	addr := listener.Addr().String()
+	go func() {
+		log.WithField("addr", addr).Info("starting server")
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.WithField("addr", addr).Debug("failed to start server")
+			respond(authCodeResponseHolder{err: fmt.Errorf("failed to start server: %v", err)})
+		}
+	}()
+
+	var a authCodeResponseHolder
+	select {
+	case a = <-ch:
+	case <-ctx.Done():
+		a = authCodeResponseHolder{err: fmt.Errorf("timed out waiting for sign in after %v", signInTimeout)}
+	}
+
+	log.WithField("addr", addr).Info("shutting down the server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.WithField("addr", addr).Debug("failed to shutdown server")
+		return "", fmt.Errorf("failed to shutdown server: %v", err)
+	}
+
+	return a.authCode, a.err
+}
+
+// getTokenFromPrompt prints the auth URL and reads the redirect URL, or just
+// the code in it, pasted by the user. The redirect URL does not load when
+// signing in on a different machine, but has the code in its address.
+func getTokenFromPrompt(config *oauth2.Config, in io.Reader, out io.Writer, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	req, err := newAuthCodeRequest(config, opts...)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "Open the URL below in a browser on any device and sign in:\n\n%v\n\n", req.authURL())
+	fmt.Fprint(out, "Paste the URL of the page it redirects to, which may fail to load, or the code in it: ")
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return nil, fmt.Errorf("unable to read the redirect URL: %v", err)
+	}
+	authCode, err := authCodeFromRedirect(req, strings.TrimSpace(line))
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := req.exchange(context.TODO(), authCode)
+	if err != nil {
+		log.Debugf("Unable to retrieve token using the code")
+		return nil, err
+	}
+
+	return tok, nil
+}
+
+// authCodeFromRedirect returns the code in the redirect URL, or the input as
+// is when it is just the code.
+func authCodeFromRedirect(req authCodeRequest, input string) (string, error) {
+	if input == "" {
+		return "", errors.New("no redirect URL or code given")
+	}
+	redirectURL, err := url.Parse(input)
+	if err != nil || redirectURL.RawQuery == "" {
+		return input, nil
+	}
+
+	return req.authCode(redirectURL.Query())
+}
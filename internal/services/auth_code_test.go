@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func newTestAuthCodeRequest(t *testing.T) authCodeRequest {
+	req, err := newAuthCodeRequest(&oauth2.Config{
+		ClientID:    "sodexwoe",
+		Endpoint:    oauth2.Endpoint{AuthURL: "https://accounts.example.com/auth"},
+		RedirectURL: "http://127.0.0.1/callback",
+		Scopes:      []string{"scope"},
+	}, oauth2.SetAuthURLParam("login_hint", "me@example.com"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestAuthCodeRequestAuthURL(t *testing.T) {
+	req := newTestAuthCodeRequest(t)
+
+	authURL, err := url.Parse(req.authURL())
+
+	require.NoError(t, err)
+	q := authURL.Query()
+	challenge := sha256.Sum256([]byte(req.verifier))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(challenge[:]), q.Get("code_challenge"))
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+	assert.Equal(t, req.state, q.Get("state"))
+	assert.Equal(t, "offline", q.Get("access_type"))
+	assert.Equal(t, "consent", q.Get("prompt"))
+	assert.Equal(t, "me@example.com", q.Get("login_hint"))
+	assert.NotEqual(t, req.state, req.verifier)
+}
+
+// callback starts serving the redirect URL of the request on a listener and
+// calls it using the query, returning the response status and body along with
+// the result of getAuthCode.
+func callback(t *testing.T, req authCodeRequest, query url.Values) (int, string, string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	type result struct {
+		authCode string
+		err      error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		authCode, err := getAuthCode(context.Background(), listener, req)
+		ch <- result{authCode, err}
+	}()
+
+	res, err := http.Get(fmt.Sprintf("http://%v/callback?%v", listener.Addr(), query.Encode()))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	r := <-ch
+	return res.StatusCode, string(body), r.authCode, r.err
+}
+
+func TestGetAuthCode(t *testing.T) {
+	req := newTestAuthCodeRequest(t)
+
+	status, _, authCode, err := callback(t, req, url.Values{"state": {req.state}, "code": {"auth-code"}})
+
+	require.NoError(t, err)
+	assert.Equal(t, "auth-code", authCode)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestGetAuthCodeStateMismatch(t *testing.T) {
+	req := newTestAuthCodeRequest(t)
+
+	status, _, _, err := callback(t, req, url.Values{"state": {"forged"}, "code": {"auth-code"}})
+
+	assert.EqualError(t, err, "sign in failed: state in the redirect URL does not match the request")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestGetAuthCodeAccessDenied(t *testing.T) {
+	req := newTestAuthCodeRequest(t)
+
+	status, body, _, err := callback(t, req, url.Values{"state": {req.state}, "error": {"access_denied"}})
+
+	assert.ErrorIs(t, err, errSignInDenied)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, body, "Sign in was denied")
+}
+
+func TestGetAuthCodeTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = getAuthCode(ctx, listener, newTestAuthCodeRequest(t))
+
+	assert.EqualError(t, err, fmt.Sprintf("timed out waiting for sign in after %v", signInTimeout))
+}
+
+func TestAuthCodeFromRedirect(t *testing.T) {
+	req := newTestAuthCodeRequest(t)
+	params := []struct {
+		name     string
+		input    string
+		authCode string
+		err      string
+	}{
+		{"RedirectURL", "http://127.0.0.1:1234/callback?state=" + req.state + "&code=4/auth-code&scope=scope", "4/auth-code", ""},
+		{"Code", "4/auth-code", "4/auth-code", ""},
+		{"StateMismatch", "http://127.0.0.1:1234/callback?state=forged&code=4/auth-code", "", "sign in failed: state in the redirect URL does not match the request"},
+		{"AccessDenied", "http://127.0.0.1:1234/callback?state=" + req.state + "&error=access_denied", "", errSignInDenied.Error()},
+		{"NoCode", "http://127.0.0.1:1234/callback?state=" + req.state, "", "sign in failed: no code in the redirect URL"},
+		{"Empty", "", "", "no redirect URL or code given"},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			authCode, err := authCodeFromRedirect(req, param.input)
+
+			if param.err != "" {
+				assert.EqualError(t, err, param.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, param.authCode, authCode)
+		})
+	}
+}
+
+// promptPipes returns the input and output of the sign in prompt, where the
+// redirect URL having the code auth-code is pasted after reading the state
+// from the auth URL.
+func promptPipes() (io.Reader, io.Writer) {
+	in, inWriter := io.Pipe()
+	outReader, out := io.Pipe()
+	go func() {
+		var prompt strings.Builder
+		buf := make([]byte, 1024)
+		for !strings.Contains(prompt.String(), "Paste") {
+			n, err := outReader.Read(buf)
+			if err != nil {
+				return
+			}
+			prompt.Write(buf[:n])
+		}
+		authURL, _ := url.Parse(strings.Fields(strings.SplitN(prompt.String(), "\n\n", 3)[1])[0])
+		fmt.Fprintf(inWriter, "http://127.0.0.1/callback?state=%v&code=auth-code\n", authURL.Query().Get("state"))
+	}()
+	return in, out
+}
+
+func TestGetTokenFromPrompt(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"access-token","refresh_token":"refresh-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+	config := &oauth2.Config{ClientID: "sodexwoe", Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example.com/auth", TokenURL: server.URL}}
+	in, out := promptPipes()
+
+	tok, err := getTokenFromPrompt(config, in, out)
+
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", tok.AccessToken)
+	assert.Equal(t, "auth-code", form.Get("code"))
+	assert.NotEmpty(t, form.Get("code_verifier"))
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+type BillCheckService interface {
+	Check(billNames []string, year int, month time.Month) (models.BillChecks, error)
+}
+
+type billCheckService struct {
+	billEmailSrv BillEmailService
+	cfg          config.Config
+}
+
+// Check compares the bills for the billed month found in the mailbox with the
+// converted bills in the download dir.
+func (s billCheckService) Check(billNames []string, year int, month time.Month) (models.BillChecks, error) {
+	loc, err := s.cfg.Location()
+	if err != nil {
+		return nil, err
+	}
+	billedPeriod := utils.MonthPeriod(year, month, loc)
+
+	result := make(models.BillChecks, 0, len(billNames))
+	for _, billName := range billNames {
+		log.WithField("billName", billName).WithField("period", billedPeriod).Info("checking bill")
+		emails, _, err := s.billEmailSrv.GetEmails([]string{billName}, billedPeriod, false)
+		if err != nil {
+			return nil, err
+		}
+		files, err := listFiles(models.BillDir(s.cfg.DownloadDir, billName, year, month))
+		if err != nil {
+			return nil, err
+		}
+
+		check := models.BillCheck{BillName: billName, MessageIds: make([]string, 0, len(emails)), Files: files, Unconverted: make([]string, 0)}
+		for _, email := range emails {
+			check.MessageIds = append(check.MessageIds, email.MessageId)
+			if _, err := os.Stat(email.OutputPath(s.cfg.DownloadDir)); errors.Is(err, fs.ErrNotExist) {
+				check.Unconverted = append(check.Unconverted, email.MessageId)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, check)
+	}
+
+	return result, nil
+}
+
+// listFiles returns the names of the files in the dir, which need not exist.
+func listFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			files = append(files, entry.Name())
+		}
+	}
+	return files, nil
+}
+
+func NewBillCheckService(billEmailSrv BillEmailService, cfg config.Config) BillCheckService {
+	return billCheckService{billEmailSrv, cfg}
+}
@@ -0,0 +1,50 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBillCheckServiceCheck(t *testing.T) {
+	server := newGmailTestServer(t)
+	cfg := config.Config{
+		DownloadDir: t.TempDir(),
+		Timezone:    "UTC",
+		BillConfigs: config.BillConfigs{
+			"airtel":  {Label: "Bills/Airtel"},
+			"act":     {From: "ebill@actcorp.in", HasAttachment: true},
+			"jio":     {From: "jio@jio.com"},
+			"tatasky": {From: "bills@tatasky.com", PeriodOffset: -1},
+		},
+	}
+	converted := models.BillEmail{MessageId: "airtel-april", BillName: "airtel", Year: 2024, Month: time.April, Bill: models.Bill{Filename: "airtel.pdf"}}
+	airtelDir := models.BillDir(cfg.DownloadDir, "airtel", 2024, time.April)
+	require.NoError(t, os.MkdirAll(airtelDir, 0755))
+	require.NoError(t, os.WriteFile(converted.OutputPath(cfg.DownloadDir), []byte("converted"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(airtelDir, "airtel-copy.pdf"), []byte("converted"), 0644))
+	tataskyDir := models.BillDir(cfg.DownloadDir, "tatasky", 2024, time.April)
+	require.NoError(t, os.MkdirAll(tataskyDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tataskyDir, "tatasky.pdf"), []byte("converted"), 0644))
+	billCheckSrv := services.NewBillCheckService(services.NewBillEmailService(services.NewGmailMailSource(server.Service(t), services.NewCacheService(t.TempDir()), cfg), cfg), cfg)
+
+	checks, err := billCheckSrv.Check([]string{"airtel", "act", "jio", "tatasky"}, 2024, time.April)
+
+	require.NoError(t, err)
+	assert.Equal(t, models.BillChecks{
+		{BillName: "airtel", MessageIds: []string{"airtel-april"}, Files: []string{"airtel-copy.pdf", "airtel_April_2024--airtel.pdf"}, Unconverted: []string{}},
+		{BillName: "act", MessageIds: []string{"act-april"}, Files: []string{}, Unconverted: []string{"act-april"}},
+		{BillName: "jio", MessageIds: []string{}, Files: []string{}, Unconverted: []string{}},
+		{BillName: "tatasky", MessageIds: []string{}, Files: []string{"tatasky.pdf"}, Unconverted: []string{}},
+	}, checks)
+	assert.Contains(t, server.Queries, "from:\"bills@tatasky.com\" (after:1714521599 before:1717200000)")
+	assert.Equal(t, []string{"duplicated", "unconverted", "missing", "ok"}, []string{checks[0].Status(), checks[1].Status(), checks[2].Status(), checks[3].Status()})
+	assert.Equal(t, []string{"jio"}, checks.Missing())
+}
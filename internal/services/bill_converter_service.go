@@ -6,6 +6,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/arunvelsriram/sodexwoe/internal/config"
 	"github.com/arunvelsriram/sodexwoe/internal/utils"
@@ -17,8 +19,13 @@ import (
 type BillConverterService interface {
 	ConvertFile(billName, input, output string) error
 	Convert(billName string, input io.ReadSeeker, output io.Writer) error
+	InvoiceNumber(billName string, input io.ReadSeeker) (string, error)
 }
 
+// pdfStringPattern matches the literal strings in a PDF content stream, which
+// hold the text of the page.
+var pdfStringPattern = regexp.MustCompile(`\((?:\\.|[^\\)])*\)`)
+
 type billConverterService struct {
 	cfg       config.Config
 	pdfCpuCfg *pdfcpu.Configuration
@@ -99,6 +106,64 @@ func (s billConverterService) Convert(billName string, input io.ReadSeeker, outp
 	return nil
 }
 
+// InvoiceNumber returns the invoice number matched by the invoice pattern of
+// the bill in the text of the bill, or an empty string when the bill has no
+// invoice pattern or the pattern does not match. Only text stored as plain
+// strings in the bill can be matched.
+func (s billConverterService) InvoiceNumber(billName string, input io.ReadSeeker) (string, error) {
+	billConfig, ok := s.cfg.BillConfigs[billName]
+	if !ok {
+		return "", fmt.Errorf("billName: %s not found in config", billName)
+	}
+	if billConfig.InvoicePattern == "" {
+		return "", nil
+	}
+	pattern, err := regexp.Compile(billConfig.InvoicePattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid invoice pattern of bill: %v: %v", billName, err)
+	}
+
+	s.pdfCpuCfg.UserPW = billConfig.Password
+	ctx, err := pdfcpuapi.ReadContext(input, s.pdfCpuCfg)
+	if err != nil {
+		return "", err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return "", err
+	}
+	for page := 1; page <= ctx.PageCount; page++ {
+		content, err := ctx.ExtractPageContent(page)
+		if err != nil {
+			return "", err
+		}
+		text, err := pageText(content)
+		if err != nil {
+			return "", err
+		}
+		if match := pattern.FindStringSubmatch(text); match != nil {
+			return match[len(match)-1], nil
+		}
+	}
+
+	log.WithField("billName", billName).Debug("invoice number not found in bill")
+	return "", nil
+}
+
+// pageText returns the strings of a page content stream, one per line.
+func pageText(content io.Reader) (string, error) {
+	b, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+
+	unescape := strings.NewReplacer(`\(`, "(", `\)`, ")", `\\`, `\`)
+	lines := make([]string, 0)
+	for _, str := range pdfStringPattern.FindAll(b, -1) {
+		lines = append(lines, unescape.Replace(string(str[1:len(str)-1])))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
 func NewBillConverterService(cfg config.Config) BillConverterService {
 	return billConverterService{cfg, pdfcpu.NewDefaultConfiguration()}
 }
@@ -0,0 +1,77 @@
+package services_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/arunvelsriram/sodexwoe/internal/testutils"
+	pdfcpuapi "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBillConverterServiceConvert(t *testing.T) {
+	cfg := config.Config{
+		BillConfigs: config.BillConfigs{
+			"airtel": {Password: "secret", KeepPages: 2, AdditionalText: "GST Number: ABC123"},
+		},
+	}
+	var output bytes.Buffer
+
+	err := services.NewBillConverterService(cfg).Convert("airtel", bytes.NewReader(testutils.BillPDF(t, "Airtel", 4, "secret")), &output)
+
+	require.NoError(t, err)
+	pageCount, err := pdfcpuapi.PageCount(bytes.NewReader(output.Bytes()), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, pageCount)
+}
+
+func TestBillConverterServiceConvertErrors(t *testing.T) {
+	params := []struct {
+		name     string
+		billName string
+		pdf      []byte
+	}{
+		{"WrongPassword", "airtel", testutils.BillPDF(t, "Airtel", 2, "other")},
+		{"NotPDF", "airtel", []byte("not a pdf")},
+		{"UnknownBill", "jio", testutils.BillPDF(t, "Jio", 2, "secret")},
+	}
+	cfg := config.Config{BillConfigs: config.BillConfigs{"airtel": {Password: "secret", KeepPages: 1}}}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			var output bytes.Buffer
+
+			err := services.NewBillConverterService(cfg).Convert(param.billName, bytes.NewReader(param.pdf), &output)
+
+			assert.Error(t, err)
+			assert.Zero(t, output.Len())
+		})
+	}
+}
+
+func TestBillConverterServiceInvoiceNumber(t *testing.T) {
+	params := []struct {
+		name     string
+		pattern  string
+		expected string
+	}{
+		{"Group", `Invoice No: (\S+)`, "INV-1"},
+		{"NoGroup", `INV-\d+`, "INV-1"},
+		{"NoMatch", `Bill No: (\S+)`, ""},
+		{"NoPattern", "", ""},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			cfg := config.Config{BillConfigs: config.BillConfigs{"airtel": {Password: "secret", InvoicePattern: param.pattern}}}
+
+			invoiceNumber, err := services.NewBillConverterService(cfg).InvoiceNumber("airtel", bytes.NewReader(testutils.BillPDF(t, "Invoice No: INV-1 (copy)", 2, "secret")))
+
+			require.NoError(t, err)
+			assert.Equal(t, param.expected, invoiceNumber)
+		})
+	}
+}
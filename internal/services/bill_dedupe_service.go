@@ -0,0 +1,135 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	log "github.com/sirupsen/logrus"
+)
+
+type BillDedupeService interface {
+	Dedupe(emails models.BillEmails) (models.BillEmails, models.SkippedEmails, error)
+	Claim(emails models.BillEmails) error
+}
+
+type billDedupeService struct {
+	billConverterSrv BillConverterService
+	cfg              config.Config
+	path             string
+}
+
+// Dedupe keeps one copy of each bill, skipping the emails having the same
+// attachment or invoice number as an earlier email of the bill, or as a bill
+// already claimed from a different email.
+func (s billDedupeService) Dedupe(emails models.BillEmails) (models.BillEmails, models.SkippedEmails, error) {
+	claimed, err := s.load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := make(models.BillEmails, 0, len(emails))
+	skipped := make(models.SkippedEmails, 0)
+	hashes := make(map[string]string)
+	invoiceNumbers := make(map[string]string)
+	for _, email := range emails {
+		invoiceNumber, err := s.billConverterSrv.InvoiceNumber(email.BillName, bytes.NewReader(email.Bill.Data))
+		if err != nil {
+			log.WithField("messageId", email.MessageId).WithField("reason", err).Warn("unable to find invoice number in bill")
+		}
+		email.Bill.InvoiceNumber = invoiceNumber
+
+		hashKey := email.BillName + "/" + email.Bill.Hash()
+		invoiceKey := email.BillName + "/" + invoiceNumber
+		reason := ""
+		if messageId, ok := hashes[hashKey]; ok {
+			reason = fmt.Sprintf("duplicate of messageId: %v, same attachment", messageId)
+		} else if messageId, ok := invoiceNumbers[invoiceKey]; ok && invoiceNumber != "" {
+			reason = fmt.Sprintf("duplicate of messageId: %v, same invoice number: %v", messageId, invoiceNumber)
+		} else if claimedBill, ok := claimed.Find(s.cfg.Mailbox(email.BillName), email); ok {
+			reason = fmt.Sprintf("bill already claimed for %v %d, messageId: %v", claimedBill.Month, claimedBill.Year, claimedBill.MessageId)
+		}
+		if reason != "" {
+			log.WithField("messageId", email.MessageId).WithField("reason", reason).Warn("skipping duplicate bill")
+			skipped = append(skipped, models.SkippedEmail{MessageId: email.MessageId, BillName: email.BillName, Reason: reason})
+			continue
+		}
+
+		hashes[hashKey] = email.MessageId
+		if invoiceNumber != "" {
+			invoiceNumbers[invoiceKey] = email.MessageId
+		}
+		result = append(result, email)
+	}
+	log.Debugf("deduplicated emails: %d", len(skipped))
+
+	return result, skipped, nil
+}
+
+// Claim records the converted bills of the emails as claimed.
+func (s billDedupeService) Claim(emails models.BillEmails) error {
+	if len(emails) == 0 {
+		return nil
+	}
+	claimed, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, email := range emails {
+		mailbox := s.cfg.Mailbox(email.BillName)
+		claimedBill := models.ClaimedBill{
+			Mailbox:       mailbox,
+			MessageId:     email.MessageId,
+			BillName:      email.BillName,
+			Year:          email.Year,
+			Month:         email.Month,
+			Hash:          email.Bill.Hash(),
+			InvoiceNumber: email.Bill.InvoiceNumber,
+			ClaimedAt:     now,
+		}
+		if i := claimed.IndexOf(mailbox, email.MessageId); i >= 0 {
+			claimedBill.ClaimedAt = claimed[i].ClaimedAt
+			claimed[i] = claimedBill
+			continue
+		}
+		claimed = append(claimed, claimedBill)
+	}
+
+	content, err := json.MarshalIndent(claimed, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.WithField("path", s.path).Infof("recording claimed bills: %d", len(emails))
+	return writeFileAtomic(s.path, content)
+}
+
+func (s billDedupeService) load() (models.ClaimedBills, error) {
+	content, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.WithField("path", s.path).Debug("no claimed bills")
+		return models.ClaimedBills{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed models.ClaimedBills
+	if err := json.Unmarshal(content, &claimed); err != nil {
+		return nil, fmt.Errorf("invalid claimed bills: %v: %v", s.path, err)
+	}
+	return claimed, nil
+}
+
+// NewBillDedupeService creates a service deduplicating bills, recording the
+// claimed bills in the file at path.
+func NewBillDedupeService(billConverterSrv BillConverterService, cfg config.Config, path string) BillDedupeService {
+	return billDedupeService{billConverterSrv, cfg, path}
+}
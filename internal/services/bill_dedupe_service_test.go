@@ -0,0 +1,140 @@
+package services_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/arunvelsriram/sodexwoe/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBillDedupeServiceDedupe(t *testing.T) {
+	cfg := config.Config{
+		BillConfigs: config.BillConfigs{
+			"airtel": {Password: "airtel", InvoicePattern: `Invoice No: (\S+)`},
+			"act":    {},
+		},
+	}
+	bill := testutils.BillPDF(t, "Invoice No: INV-1", 1, "airtel")
+	reminder := testutils.BillPDF(t, "Invoice No: INV-1", 2, "airtel")
+	emails := models.BillEmails{
+		{MessageId: "airtel-april", BillName: "airtel", Year: 2024, Month: time.April, Bill: models.Bill{Filename: "airtel.pdf", Data: bill}},
+		{MessageId: "airtel-resent", BillName: "airtel", Year: 2024, Month: time.April, Bill: models.Bill{Filename: "airtel.pdf", Data: bill}},
+		{MessageId: "airtel-reminder", BillName: "airtel", Year: 2024, Month: time.May, Bill: models.Bill{Filename: "airtel.pdf", Data: reminder}},
+		{MessageId: "act-april", BillName: "act", Year: 2024, Month: time.April, Bill: models.Bill{Filename: "act.pdf", Data: bill}},
+	}
+	billDedupeSrv := services.NewBillDedupeService(services.NewBillConverterService(cfg), cfg, filepath.Join(t.TempDir(), "claimed.json"))
+
+	deduped, skipped, err := billDedupeSrv.Dedupe(emails)
+
+	require.NoError(t, err)
+	require.Len(t, deduped, 2)
+	assert.Equal(t, "airtel-april", deduped[0].MessageId)
+	assert.Equal(t, "INV-1", deduped[0].Bill.InvoiceNumber)
+	assert.Equal(t, "act-april", deduped[1].MessageId)
+	assert.Equal(t, "", deduped[1].Bill.InvoiceNumber)
+	assert.Equal(t, models.SkippedEmails{
+		{MessageId: "airtel-resent", BillName: "airtel", Reason: "duplicate of messageId: airtel-april, same attachment"},
+		{MessageId: "airtel-reminder", BillName: "airtel", Reason: "duplicate of messageId: airtel-april, same invoice number: INV-1"},
+	}, skipped)
+}
+
+func TestBillDedupeServiceClaim(t *testing.T) {
+	cfg := config.Config{BillConfigs: config.BillConfigs{"airtel": {Password: "airtel", InvoicePattern: `Invoice No: (\S+)`}}}
+	bill := testutils.BillPDF(t, "Invoice No: INV-1", 1, "airtel")
+	email := models.BillEmail{MessageId: "airtel-april", BillName: "airtel", Year: 2024, Month: time.April, Bill: models.Bill{Filename: "airtel.pdf", Data: bill}}
+	billDedupeSrv := services.NewBillDedupeService(services.NewBillConverterService(cfg), cfg, filepath.Join(t.TempDir(), "claimed.json"))
+	deduped, _, err := billDedupeSrv.Dedupe(models.BillEmails{email})
+	require.NoError(t, err)
+	require.NoError(t, billDedupeSrv.Claim(deduped))
+
+	resent := email
+	resent.MessageId = "airtel-resent"
+	reminder := email
+	reminder.MessageId = "airtel-reminder"
+	reminder.Month = time.May
+	reminder.Bill.Data = testutils.BillPDF(t, "Invoice No: INV-1", 2, "airtel")
+	deduped, skipped, err := billDedupeSrv.Dedupe(models.BillEmails{email, resent, reminder})
+
+	require.NoError(t, err)
+	require.Len(t, deduped, 1)
+	assert.Equal(t, "airtel-april", deduped[0].MessageId)
+	assert.Equal(t, models.SkippedEmails{
+		{MessageId: "airtel-resent", BillName: "airtel", Reason: "duplicate of messageId: airtel-april, same attachment"},
+		{MessageId: "airtel-reminder", BillName: "airtel", Reason: "duplicate of messageId: airtel-april, same invoice number: INV-1"},
+	}, skipped)
+
+	deduped, skipped, err = billDedupeSrv.Dedupe(models.BillEmails{resent, reminder})
+
+	require.NoError(t, err)
+	assert.Empty(t, deduped)
+	assert.Equal(t, models.SkippedEmails{
+		{MessageId: "airtel-resent", BillName: "airtel", Reason: "bill already claimed for April 2024, messageId: airtel-april"},
+		{MessageId: "airtel-reminder", BillName: "airtel", Reason: "bill already claimed for April 2024, messageId: airtel-april"},
+	}, skipped)
+}
+
+func TestBillDedupeServiceClaimAccounts(t *testing.T) {
+	cfg := config.Config{
+		Accounts: config.Accounts{"office": {}},
+		BillConfigs: config.BillConfigs{
+			"airtel": {Password: "airtel"},
+			"jio":    {Password: "jio", Account: "office"},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "claimed.json")
+	billDedupeSrv := services.NewBillDedupeService(services.NewBillConverterService(cfg), cfg, path)
+	airtel := models.BillEmail{MessageId: "msg-1", BillName: "airtel", Year: 2024, Month: time.April, Bill: models.Bill{Filename: "airtel.pdf", Data: testutils.BillPDF(t, "Airtel", 1, "airtel")}}
+	jio := models.BillEmail{MessageId: "msg-1", BillName: "jio", Year: 2024, Month: time.April, Bill: models.Bill{Filename: "jio.pdf", Data: testutils.BillPDF(t, "Jio", 1, "jio")}}
+
+	require.NoError(t, billDedupeSrv.Claim(models.BillEmails{airtel}))
+	require.NoError(t, billDedupeSrv.Claim(models.BillEmails{jio}))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var claimed models.ClaimedBills
+	require.NoError(t, json.Unmarshal(content, &claimed))
+	require.Len(t, claimed, 2)
+	assert.Equal(t, "gmail", claimed[0].Mailbox)
+	assert.Equal(t, "airtel", claimed[0].BillName)
+	assert.Equal(t, "gmail/office", claimed[1].Mailbox)
+	assert.Equal(t, "jio", claimed[1].BillName)
+	resent := airtel
+	resent.MessageId = "msg-2"
+	deduped, skipped, err := billDedupeSrv.Dedupe(models.BillEmails{resent})
+	require.NoError(t, err)
+	assert.Empty(t, deduped)
+	assert.Equal(t, models.SkippedEmails{
+		{MessageId: "msg-2", BillName: "airtel", Reason: "bill already claimed for April 2024, messageId: msg-1"},
+	}, skipped)
+}
+
+func TestBillDedupeServiceClaimedWithoutMailbox(t *testing.T) {
+	cfg := config.Config{BillConfigs: config.BillConfigs{"airtel": {Password: "airtel"}}}
+	email := models.BillEmail{MessageId: "airtel-april", BillName: "airtel", Year: 2024, Month: time.April, Bill: models.Bill{Filename: "airtel.pdf", Data: testutils.BillPDF(t, "Airtel", 1, "airtel")}}
+	path := filepath.Join(t.TempDir(), "claimed.json")
+	content, err := json.Marshal(models.ClaimedBills{{MessageId: "airtel-april", BillName: "airtel", Year: 2024, Month: time.April, Hash: email.Bill.Hash()}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, content, 0644))
+	billDedupeSrv := services.NewBillDedupeService(services.NewBillConverterService(cfg), cfg, path)
+
+	deduped, skipped, err := billDedupeSrv.Dedupe(models.BillEmails{email})
+	require.NoError(t, err)
+	require.NoError(t, billDedupeSrv.Claim(deduped))
+
+	assert.Len(t, deduped, 1)
+	assert.Empty(t, skipped)
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	var claimed models.ClaimedBills
+	require.NoError(t, json.Unmarshal(content, &claimed))
+	require.Len(t, claimed, 1)
+	assert.Equal(t, "gmail", claimed[0].Mailbox)
+}
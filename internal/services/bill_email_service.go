@@ -1,154 +1,244 @@
 package services
 
 import (
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"strings"
-	"time"
+	"sort"
 
 	"github.com/arunvelsriram/sodexwoe/internal/config"
-	"github.com/arunvelsriram/sodexwoe/internal/constants"
 	"github.com/arunvelsriram/sodexwoe/internal/models"
 	"github.com/arunvelsriram/sodexwoe/internal/utils"
 	log "github.com/sirupsen/logrus"
-	"google.golang.org/api/gmail/v1"
 )
 
 type BillEmailService interface {
-	GetLabels(billNames ...string) (models.BillEmailLabels, error)
-	GetEmails(billNames []string, year int, month time.Month) (models.BillEmails, error)
+	GetEmails(billNames []string, period utils.Period, strict bool) (models.BillEmails, models.SkippedEmails, error)
+	GetHistoryId() (uint64, error)
+	GetNewEmails(startHistoryIds map[string]uint64, strict bool) (models.BillEmails, models.SkippedEmails, uint64, error)
+	MarkProcessed(emails models.BillEmails) error
 }
 
+var errNoAttachment = errors.New("no attachment found in email")
+
 type billEmailService struct {
-	gmailSrv *gmail.Service
-	cfg      config.Config
+	mailSrc MailSource
+	cfg     config.Config
 }
 
-func (s billEmailService) GetLabels(billNames ...string) (models.BillEmailLabels, error) {
-	labelNames, err := s.cfg.Labels(billNames)
-	if err != nil {
-		return nil, err
-	}
+// GetEmails returns the bill emails billing the period, which are received
+// within the period shifted by the period offset of the bill. Unless strict is
+// set, emails that are unexpected or without a bill attachment are skipped and
+// reported instead of failing.
+func (s billEmailService) GetEmails(billNames []string, period utils.Period, strict bool) (models.BillEmails, models.SkippedEmails, error) {
+	result := make(models.BillEmails, 0, len(billNames))
+	skipped := make(models.SkippedEmails, 0)
+	attributed := make(map[string]string)
+	for _, billName := range billNames {
+		receivedPeriod, err := s.receivedPeriod(billName, period)
+		if err != nil {
+			return nil, nil, err
+		}
+		messageIds, err := s.mailSrc.Search(billName, receivedPeriod)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.WithField("billName", billName).WithField("period", receivedPeriod).Debugf("listed emails: %d", len(messageIds))
 
-	log.Info("listing labels from gmail")
-	labelsResponse, err := s.gmailSrv.Users.Labels.List(constants.GMAIL_USER).Do()
-	if err != nil {
-		return nil, err
-	}
-	log.Debugf("listed labels: %v", len(labelsResponse.Labels))
-	labelNameToLabel := make(map[string]*gmail.Label, len(labelsResponse.Labels))
-	for _, label := range labelsResponse.Labels {
-		labelNameToLabel[label.Name] = label
+		emails, err := s.getEmails(billName, messageIds, func(models.MailMessage) utils.Period { return period }, attributed, strict, &skipped)
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, emails...)
 	}
+	log.Debugf("fetched emails: %d", len(result))
+	log.Debugf("skipped emails: %d", len(skipped))
 
-	log.Debug("filtering listed labels")
-	result := make(models.BillEmailLabels, 0, len(labelsResponse.Labels))
-	for i := 0; i < len(labelNames); i++ {
-		if label, ok := labelNameToLabel[labelNames[i]]; ok {
-			billEmailLabel := models.BillEmailLabel{
-				BillName: billNames[i],
-				Label:    label,
-			}
-			result = append(result, billEmailLabel)
-		} else {
-			return nil, fmt.Errorf("label not found: %v", labelNames[i])
-		}
+	return result, skipped, nil
+}
+
+// GetHistoryId returns the current history id of the mailbox.
+func (s billEmailService) GetHistoryId() (uint64, error) {
+	historySrc, ok := s.mailSrc.(HistoryMailSource)
+	if !ok {
+		return 0, errors.New("mail source does not support sync")
 	}
-	log.Debugf("filtered labels: %v", len(result))
 
-	return result, nil
+	return historySrc.HistoryId()
 }
 
-func (s billEmailService) GetEmails(billNames []string, year int, month time.Month) (models.BillEmails, error) {
-	billEmailLabels, err := s.GetLabels(billNames...)
+// GetNewEmails returns the bill emails that got each bill after its start
+// history id, along with the history id to continue all of them from next
+// time. The billed period of each email is determined from when it was
+// received.
+func (s billEmailService) GetNewEmails(startHistoryIds map[string]uint64, strict bool) (models.BillEmails, models.SkippedEmails, uint64, error) {
+	historySrc, ok := s.mailSrc.(HistoryMailSource)
+	if !ok {
+		return nil, nil, 0, errors.New("mail source does not support sync")
+	}
+	loc, err := s.cfg.Location()
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
 	}
 
-	labelQ := utils.AnyLabelQ(billEmailLabels.LabelNames()...)
-	dateRangeQ := utils.WithinMonthQ(year, month)
-	q := fmt.Sprintf("%s %s", labelQ, dateRangeQ)
-	log.WithField("query", q).Info("listing emails from gmail")
-	messagesResponse, err := s.gmailSrv.Users.Messages.List(constants.GMAIL_USER).Q(q).Do()
+	billMessageIds, historyId, err := historySrc.NewMessages(startHistoryIds)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
 	}
+	billNames := make([]string, 0, len(startHistoryIds))
+	for billName := range startHistoryIds {
+		billNames = append(billNames, billName)
+	}
+	sort.Strings(billNames)
+
+	result := make(models.BillEmails, 0)
+	skipped := make(models.SkippedEmails, 0)
+	attributed := make(map[string]string)
+	for _, billName := range billNames {
+		messageIds, ok := billMessageIds[billName]
+		if !ok {
+			continue
+		}
 
-	messages := messagesResponse.Messages
-	log.Debugf("listed emails: %d", len(messages))
-	result := make(models.BillEmails, 0, len(messages))
-	log.Info("fetching emails from gmail")
-	for _, m := range messagesResponse.Messages {
-		log.WithField("messageId", m.Id).Debug("fetching email")
-		message, err := s.gmailSrv.Users.Messages.Get(constants.GMAIL_USER, m.Id).Do()
+		billConfig, err := s.cfg.Bill(billName)
 		if err != nil {
-			return nil, err
+			return nil, nil, 0, err
 		}
-
-		log.WithField("messageId", m.Id).
-			WithField("messageLabelIds", message.LabelIds).
-			Debug("determining bill label for the message")
-		var billEmailLabel *models.BillEmailLabel
-		for _, labelId := range message.LabelIds {
-			if billEmailLabel = billEmailLabels.FindById(labelId); billEmailLabel != nil {
-				break
-			}
+		billedPeriod := func(message models.MailMessage) utils.Period {
+			received := message.Received.In(loc)
+			return utils.MonthPeriod(received.Year(), received.Month(), loc).AddMonths(billConfig.PeriodOffset)
 		}
-		if billEmailLabel == nil {
-			log.WithField("messageId", message.Id).
-				WithField("messageLabelIds", message.LabelIds).
-				WithField("billLabelIds", billEmailLabels.LabelIds()).
-				WithField("billLabelNames", billEmailLabels.LabelNames()).
-				Errorf("unexpected email - email labels not having any of the bill labels")
-			return nil, fmt.Errorf("got unexpected email, messageId: %v", message.Id)
+		emails, err := s.getEmails(billName, messageIds, billedPeriod, attributed, strict, &skipped)
+		if err != nil {
+			return nil, nil, 0, err
 		}
+		result = append(result, emails...)
+	}
+	log.Debugf("fetched new emails: %d", len(result))
+
+	return result, skipped, historyId, nil
+}
+
+// MarkProcessed marks the emails as processed in the mail source.
+func (s billEmailService) MarkProcessed(emails models.BillEmails) error {
+	marker, ok := s.mailSrc.(ProcessedMarker)
+	if !ok {
+		return errors.New("mail source does not support marking emails as processed")
+	}
+
+	messageIds := make([]string, 0, len(emails))
+	for _, email := range emails {
+		messageIds = append(messageIds, email.MessageId)
+	}
+	return marker.MarkProcessed(messageIds)
+}
 
-		var attachmentId string
-		var attachmentFilename string
-		for _, p := range message.Payload.Parts {
-			if p.Filename != "" && strings.Contains(p.Filename, ".pdf") {
-				attachmentId = p.Body.AttachmentId
-				attachmentFilename = p.Filename
-				log.WithField("messageId", message.Id).
-					WithField("attachmentId", attachmentId).
-					WithField("filename", attachmentFilename).
-					Debug("found pdf attachment in email")
-				break
+// getEmails reads the bills of the emails. Emails already attributed to a
+// different bill are skipped, as an email is expected to have a single bill.
+func (s billEmailService) getEmails(billName string, messageIds []string, billedPeriod func(models.MailMessage) utils.Period,
+	attributed map[string]string, strict bool, skipped *models.SkippedEmails) (models.BillEmails, error) {
+	result := make(models.BillEmails, 0, len(messageIds))
+	for _, messageId := range messageIds {
+		if attributedBillName, ok := attributed[messageId]; ok {
+			if attributedBillName == billName {
+				continue
 			}
+			log.WithField("messageId", messageId).
+				WithField("billName", billName).
+				WithField("attributedBillName", attributedBillName).
+				Error("unexpected email - email matching more than one bill")
+			err := fmt.Errorf("got unexpected email, messageId: %v", messageId)
+			skippedEmail := models.SkippedEmail{
+				MessageId: messageId,
+				BillName:  billName,
+				Reason:    fmt.Sprintf("email already attributed to bill: %v", attributedBillName),
+			}
+			if err = skip(strict, skipped, skippedEmail, err); err != nil {
+				return nil, err
+			}
+			continue
 		}
-		if attachmentId == "" || attachmentFilename == "" {
-			log.WithField("messageId", message.Id).Error("no attachment found in email")
-			return nil, fmt.Errorf("no attachment found in email, messageId: %v", message.Id)
-		}
+		attributed[messageId] = billName
 
-		log.WithField("attachmentId", attachmentId).Debug("fetching attachment")
-		attachmentRes, err := s.gmailSrv.Users.Messages.Attachments.Get(constants.GMAIL_USER, message.Id, attachmentId).Do()
+		message, err := s.mailSrc.Message(messageId)
+		if errors.Is(err, ErrMessageNotFound) {
+			skippedEmail := models.SkippedEmail{MessageId: messageId, BillName: billName, Reason: ErrMessageNotFound.Error()}
+			if err = skip(strict, skipped, skippedEmail, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		log.Debug("decoding attachment content")
-		content, err := base64.URLEncoding.DecodeString(attachmentRes.Data)
+		bill, err := s.getBill(message)
+		if errors.Is(err, errNoAttachment) {
+			skippedEmail := models.SkippedEmail{MessageId: message.Id, BillName: billName, Reason: errNoAttachment.Error()}
+			if err = skip(strict, skipped, skippedEmail, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
 
+		period := billedPeriod(message)
 		billEmail := models.BillEmail{
-			BillName: billEmailLabel.BillName,
-			Year:     year,
-			Month:    month,
-			Bill: models.Bill{
-				Filename: attachmentFilename,
-				Data:     content,
-			},
+			MessageId: message.Id,
+			BillName:  billName,
+			Year:      period.Year(),
+			Month:     period.Month(),
+			Bill:      bill,
 		}
 		result = append(result, billEmail)
 	}
-	log.Debugf("fetched emails: %d", len(result))
 
 	return result, nil
 }
 
-func NewBillEmailService(gmailSrv *gmail.Service, cfg config.Config) BillEmailService {
-	return billEmailService{gmailSrv, cfg}
+// receivedPeriod returns the period the emails of a bill billing the given
+// period are received within, using the period offset of the bill.
+func (s billEmailService) receivedPeriod(billName string, period utils.Period) (utils.Period, error) {
+	billConfig, err := s.cfg.Bill(billName)
+	if err != nil {
+		return utils.Period{}, err
+	}
+
+	return period.AddMonths(-billConfig.PeriodOffset), nil
+}
+
+func (s billEmailService) getBill(message models.MailMessage) (models.Bill, error) {
+	attachment, ok := message.PDFAttachment()
+	if !ok {
+		log.WithField("messageId", message.Id).Error("no attachment found in email")
+		return models.Bill{}, fmt.Errorf("%w, messageId: %v", errNoAttachment, message.Id)
+	}
+	log.WithField("messageId", message.Id).
+		WithField("attachmentId", attachment.Id).
+		WithField("filename", attachment.Filename).
+		Debug("found pdf attachment in email")
+
+	content, err := s.mailSrc.Attachment(message, attachment)
+	if err != nil {
+		return models.Bill{}, err
+	}
+
+	return models.Bill{Filename: attachment.Filename, Data: content}, nil
+}
+
+// skip records the email as skipped, or returns err when running in strict
+// mode.
+func skip(strict bool, skipped *models.SkippedEmails, email models.SkippedEmail, err error) error {
+	if strict {
+		return err
+	}
+
+	log.WithField("messageId", email.MessageId).WithField("reason", email.Reason).Warn("skipping email")
+	*skipped = append(*skipped, email)
+	return nil
+}
+
+func NewBillEmailService(mailSrc MailSource, cfg config.Config) BillEmailService {
+	return billEmailService{mailSrc, cfg}
 }
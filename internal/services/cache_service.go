@@ -0,0 +1,236 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cacheEntriesDir        = "entries"
+	cacheAttachmentsDir    = "attachments"
+	labelsCacheKey         = "labels"
+	messagesCacheKeyPrefix = "messages/"
+	queriesCacheKeyPrefix  = "queries/"
+)
+
+type CacheService interface {
+	Get(key string, v interface{}) (bool, error)
+	Put(key string, v interface{}) error
+	GetAttachment(hash string) ([]byte, bool, error)
+	PutAttachment(data []byte) (string, error)
+	Entries() (models.CacheEntries, error)
+	Prune(olderThan time.Duration) (models.CacheEntries, error)
+	Clear() error
+}
+
+// cacheService stores JSON entries by key and attachments by the SHA-256 hash
+// of their content under dir.
+type cacheService struct {
+	dir string
+}
+
+func (s cacheService) entryPath(key string) string {
+	return filepath.Join(s.dir, cacheEntriesDir, filepath.FromSlash(key)+".json")
+}
+
+func (s cacheService) attachmentPath(hash string) string {
+	return filepath.Join(s.dir, cacheAttachmentsDir, hash)
+}
+
+func (s cacheService) Get(key string, v interface{}) (bool, error) {
+	content, err := os.ReadFile(s.entryPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		log.WithField("key", key).Debug("cache miss")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	log.WithField("key", key).Debug("cache hit")
+	if err := json.Unmarshal(content, v); err != nil {
+		return false, fmt.Errorf("corrupt cache entry: %v: %v", key, err)
+	}
+	return true, nil
+}
+
+func (s cacheService) Put(key string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("key", key).Debug("writing cache entry")
+	return writeFileAtomic(s.entryPath(key), content)
+}
+
+func (s cacheService) GetAttachment(hash string) ([]byte, bool, error) {
+	content, err := os.ReadFile(s.attachmentPath(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		log.WithField("hash", hash).Debug("attachment cache miss")
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if actual := contentHash(content); actual != hash {
+		return nil, false, fmt.Errorf("corrupt cached attachment: %v", hash)
+	}
+	log.WithField("hash", hash).Debug("attachment cache hit")
+	return content, true, nil
+}
+
+func (s cacheService) PutAttachment(data []byte) (string, error) {
+	hash := contentHash(data)
+	path := s.attachmentPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	log.WithField("hash", hash).Debug("writing cached attachment")
+	return hash, writeFileAtomic(path, data)
+}
+
+func (s cacheService) Entries() (models.CacheEntries, error) {
+	result := make(models.CacheEntries, 0)
+	for _, kind := range []string{cacheEntriesDir, cacheAttachmentsDir} {
+		root := filepath.Join(s.dir, kind)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && path == root {
+				return filepath.SkipDir
+			}
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+
+			entry := models.CacheEntry{
+				Key:     strings.TrimSuffix(filepath.ToSlash(rel), ".json"),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			}
+			if kind == cacheAttachmentsDir {
+				entry.Key = filepath.ToSlash(filepath.Join(cacheAttachmentsDir, rel))
+			}
+			result = append(result, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Prune removes the entries not modified within olderThan, and then the
+// attachments that are not referenced by any of the remaining messages.
+func (s cacheService) Prune(olderThan time.Duration) (models.CacheEntries, error) {
+	entries, err := s.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := make(models.CacheEntries, 0)
+	hashes := make(map[string]bool)
+	cutoff := time.Now().Add(-olderThan)
+	for _, entry := range entries {
+		if entry.IsAttachment() {
+			continue
+		}
+		if olderThan > 0 && entry.ModTime.Before(cutoff) {
+			log.WithField("key", entry.Key).Debug("pruning cache entry")
+			if err := os.Remove(s.entryPath(entry.Key)); err != nil {
+				return nil, err
+			}
+			pruned = append(pruned, entry)
+			continue
+		}
+
+		if !strings.HasPrefix(entry.Key, messagesCacheKeyPrefix) {
+			continue
+		}
+		var cachedMessage models.CachedMessage
+		if _, err := s.Get(entry.Key, &cachedMessage); err != nil {
+			return nil, err
+		}
+		for _, hash := range cachedMessage.Attachments {
+			hashes[hash] = true
+		}
+	}
+
+	for _, entry := range entries {
+		if !entry.IsAttachment() || hashes[entry.Hash()] {
+			continue
+		}
+		log.WithField("key", entry.Key).Debug("pruning unreferenced attachment")
+		if err := os.Remove(s.attachmentPath(entry.Hash())); err != nil {
+			return nil, err
+		}
+		pruned = append(pruned, entry)
+	}
+
+	return pruned, nil
+}
+
+func (s cacheService) Clear() error {
+	log.WithField("dir", s.dir).Info("clearing cache")
+	return os.RemoveAll(s.dir)
+}
+
+func messageCacheKey(messageId string) string {
+	return messagesCacheKeyPrefix + messageId
+}
+
+func queryCacheKey(q string) string {
+	return queriesCacheKeyPrefix + contentHash([]byte(q))
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and renames
+// it, so that an interrupted write never leaves a partial file behind.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := utils.CreateTempFile(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func NewCacheService(dir string) CacheService {
+	return cacheService{dir}
+}
@@ -0,0 +1,113 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheServiceGetPut(t *testing.T) {
+	cacheSrv := services.NewCacheService(t.TempDir())
+	var ids []string
+
+	found, err := cacheSrv.Get("queries/airtel", &ids)
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	require.NoError(t, cacheSrv.Put("queries/airtel", []string{"airtel-april", "airtel-march"}))
+	found, err = cacheSrv.Get("queries/airtel", &ids)
+
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{"airtel-april", "airtel-march"}, ids)
+}
+
+func TestCacheServiceGetCorruptEntry(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string][]byte{"entries/labels.json": []byte("{")})
+	var labels []string
+
+	_, err := services.NewCacheService(dir).Get("labels", &labels)
+
+	assert.ErrorContains(t, err, "corrupt cache entry: labels")
+}
+
+func TestCacheServiceAttachment(t *testing.T) {
+	dir := t.TempDir()
+	cacheSrv := services.NewCacheService(dir)
+
+	hash, err := cacheSrv.PutAttachment([]byte("airtel bill"))
+	require.NoError(t, err)
+	data, found, err := cacheSrv.GetAttachment(hash)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("airtel bill"), data)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "attachments", hash), []byte("airtel bil"), 0644))
+	_, _, err = cacheSrv.GetAttachment(hash)
+
+	assert.EqualError(t, err, "corrupt cached attachment: "+hash)
+}
+
+func TestCacheServicePrune(t *testing.T) {
+	dir := t.TempDir()
+	cacheSrv := services.NewCacheService(dir)
+	oldHash, err := cacheSrv.PutAttachment([]byte("airtel march bill"))
+	require.NoError(t, err)
+	newHash, err := cacheSrv.PutAttachment([]byte("airtel april bill"))
+	require.NoError(t, err)
+	unreferencedHash, err := cacheSrv.PutAttachment([]byte("offers"))
+	require.NoError(t, err)
+	require.NoError(t, cacheSrv.Put("messages/airtel-march", models.CachedMessage{Attachments: map[string]string{"1": oldHash}}))
+	require.NoError(t, cacheSrv.Put("messages/airtel-april", models.CachedMessage{Attachments: map[string]string{"1": newHash}}))
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "entries", "messages", "airtel-march.json"), old, old))
+
+	pruned, err := cacheSrv.Prune(24 * time.Hour)
+
+	require.NoError(t, err)
+	prunedKeys := make([]string, 0)
+	for _, entry := range pruned {
+		prunedKeys = append(prunedKeys, entry.Key)
+	}
+	assert.ElementsMatch(t, []string{"messages/airtel-march", "attachments/" + oldHash, "attachments/" + unreferencedHash}, prunedKeys)
+	entries, err := cacheSrv.Entries()
+	require.NoError(t, err)
+	keys := make([]string, 0)
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	assert.ElementsMatch(t, []string{"messages/airtel-april", "attachments/" + newHash}, keys)
+}
+
+func TestCacheServicePruneUnreferencedOnly(t *testing.T) {
+	cacheSrv := services.NewCacheService(t.TempDir())
+	hash, err := cacheSrv.PutAttachment([]byte("offers"))
+	require.NoError(t, err)
+	require.NoError(t, cacheSrv.Put("labels", []string{"Bills/Airtel"}))
+
+	pruned, err := cacheSrv.Prune(0)
+
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, "attachments/"+hash, pruned[0].Key)
+}
+
+func TestCacheServiceClear(t *testing.T) {
+	cacheSrv := services.NewCacheService(filepath.Join(t.TempDir(), "cache"))
+	require.NoError(t, cacheSrv.Put("labels", []string{"Bills/Airtel"}))
+	_, err := cacheSrv.PutAttachment([]byte("airtel bill"))
+	require.NoError(t, err)
+
+	require.NoError(t, cacheSrv.Clear())
+
+	entries, err := cacheSrv.Entries()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
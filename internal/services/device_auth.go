@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// deviceCodeDefaultInterval is the interval of polling the token endpoint when
+// none is given, and by which it is increased when asked to slow down.
+var deviceCodeDefaultInterval = 5 * time.Second
+
+// errDeviceAuthNotAllowed is returned when the client is not allowed to use
+// the device authorization grant, or not for the requested scopes.
+var errDeviceAuthNotAllowed = errors.New("device authorization not allowed")
+
+// deviceAuthResponse is the response of an OAuth 2.0 device authorization
+// request (RFC 8628).
+type deviceAuthResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	// VerificationURL is used by Google in place of VerificationURI.
+	VerificationURL  string `json:"verification_url"`
+	ExpiresIn        int    `json:"expires_in"`
+	Interval         int    `json:"interval"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// getTokenFromDevice gets a token using the OAuth 2.0 device authorization
+// grant. The user is asked to enter a code on a page that can be opened on any
+// device, written to out, while the token endpoint is polled until they sign
+// in.
+func getTokenFromDevice(ctx context.Context, httpClient *http.Client, config *oauth2.Config, deviceAuthURL string, out io.Writer) (*oauth2.Token, error) {
+	params := url.Values{"client_id": {config.ClientID}, "scope": {strings.Join(config.Scopes, " ")}}
+	var authRes deviceAuthResponse
+	if err := postForm(ctx, httpClient, deviceAuthURL, params, &authRes); err != nil {
+		return nil, fmt.Errorf("device authorization request failed: %v", err)
+	}
+	switch authRes.Error {
+	case "":
+	case "invalid_client", "unauthorized_client", "invalid_scope", "restricted_client":
+		return nil, fmt.Errorf("%w: %v: %v", errDeviceAuthNotAllowed, authRes.Error, authRes.ErrorDescription)
+	default:
+		return nil, fmt.Errorf("device authorization request failed: %v: %v", authRes.Error, authRes.ErrorDescription)
+	}
+	if authRes.DeviceCode == "" {
+		return nil, errors.New("device authorization request failed: no device code in response")
+	}
+	verificationURI := authRes.VerificationURI
+	if verificationURI == "" {
+		verificationURI = authRes.VerificationURL
+	}
+	fmt.Fprintf(out, "To sign in, open %v and enter the code: %v\n", verificationURI, authRes.UserCode)
+
+	interval := time.Duration(authRes.Interval) * time.Second
+	if interval <= 0 {
+		interval = deviceCodeDefaultInterval
+	}
+	if authRes.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(authRes.ExpiresIn)*time.Second)
+		defer cancel()
+	}
+
+	params = url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {authRes.DeviceCode}, "client_id": {config.ClientID}}
+	if config.ClientSecret != "" {
+		params.Set("client_secret", config.ClientSecret)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.New("device code expired before signing in")
+		case <-time.After(interval):
+		}
+
+		var tokenRes deviceTokenResponse
+		if err := postForm(ctx, httpClient, config.Endpoint.TokenURL, params, &tokenRes); err != nil {
+			if ctx.Err() != nil {
+				return nil, errors.New("device code expired before signing in")
+			}
+			return nil, fmt.Errorf("device token request failed: %v", err)
+		}
+		switch tokenRes.Error {
+		case "":
+			token := &oauth2.Token{
+				AccessToken:  tokenRes.AccessToken,
+				TokenType:    tokenRes.TokenType,
+				RefreshToken: tokenRes.RefreshToken,
+			}
+			if tokenRes.ExpiresIn > 0 {
+				token.Expiry = time.Now().Add(time.Duration(tokenRes.ExpiresIn) * time.Second)
+			}
+			return token, nil
+		case "authorization_pending":
+			log.Debug("waiting for sign in on device")
+		case "slow_down":
+			interval += deviceCodeDefaultInterval
+		case "access_denied":
+			return nil, errSignInDenied
+		case "expired_token":
+			return nil, errors.New("device code expired before signing in")
+		default:
+			return nil, fmt.Errorf("device token request failed: %v: %v", tokenRes.Error, tokenRes.ErrorDescription)
+		}
+	}
+}
+
+// postForm posts the form and decodes the JSON response. OAuth errors are
+// decoded into v too, as they are reported with a 400 status.
+func postForm(ctx context.Context, httpClient *http.Client, endpoint string, params url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status: %v", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("unable to decode response: %v: %v", res.Status, err)
+	}
+	return nil
+}
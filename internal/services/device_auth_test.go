@@ -0,0 +1,163 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+const (
+	testDeviceAuthResponse = `{"device_code":"device-code","user_code":"ABCD-EFGH","verification_url":"https://www.google.com/device","expires_in":1800}`
+	testTokenResponse      = `{"access_token":"access-token","refresh_token":"refresh-token","token_type":"Bearer","expires_in":3600}`
+)
+
+// deviceServer is a fake device authorization endpoint, responding with the
+// auth response, and token endpoint, responding to each poll with the next of
+// the grant errors and then with a token.
+type deviceServer struct {
+	config        *oauth2.Config
+	deviceAuthURL string
+	polls         []url.Values
+	polledAt      []time.Time
+}
+
+// pollQuickly polls the token endpoint without waiting for seconds.
+func pollQuickly(t *testing.T) {
+	interval := deviceCodeDefaultInterval
+	deviceCodeDefaultInterval = 10 * time.Millisecond
+	t.Cleanup(func() { deviceCodeDefaultInterval = interval })
+}
+
+func newDeviceServer(t *testing.T, authResponse string, grantErrors ...string) *deviceServer {
+	pollQuickly(t)
+	s := &deviceServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/code", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(authResponse, `"error"`) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(authResponse))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		s.polls = append(s.polls, r.PostForm)
+		s.polledAt = append(s.polledAt, time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		if len(s.polls) <= len(grantErrors) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"` + grantErrors[len(s.polls)-1] + `"}`))
+			return
+		}
+		w.Write([]byte(testTokenResponse))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	s.config = &oauth2.Config{
+		ClientID: "sodexwoe",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example.com/auth", TokenURL: server.URL + "/token"},
+		Scopes:   []string{"scope"},
+	}
+	s.deviceAuthURL = server.URL + "/device/code"
+	return s
+}
+
+func TestGetTokenFromDevice(t *testing.T) {
+	s := newDeviceServer(t, testDeviceAuthResponse, "authorization_pending", "authorization_pending")
+	var out bytes.Buffer
+
+	tok, err := getTokenFromDevice(context.Background(), http.DefaultClient, s.config, s.deviceAuthURL, &out)
+
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", tok.AccessToken)
+	assert.Equal(t, "refresh-token", tok.RefreshToken)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), tok.Expiry, time.Minute)
+	assert.Equal(t, "To sign in, open https://www.google.com/device and enter the code: ABCD-EFGH\n", out.String())
+	require.Len(t, s.polls, 3)
+	for _, poll := range s.polls {
+		assert.Equal(t, deviceCodeGrantType, poll.Get("grant_type"))
+		assert.Equal(t, "device-code", poll.Get("device_code"))
+		assert.Equal(t, "sodexwoe", poll.Get("client_id"))
+	}
+}
+
+func TestGetTokenFromDeviceSlowDown(t *testing.T) {
+	s := newDeviceServer(t, testDeviceAuthResponse, "authorization_pending", "slow_down")
+
+	_, err := getTokenFromDevice(context.Background(), http.DefaultClient, s.config, s.deviceAuthURL, io.Discard)
+
+	require.NoError(t, err)
+	require.Len(t, s.polledAt, 3)
+	assert.GreaterOrEqual(t, s.polledAt[2].Sub(s.polledAt[1]), 2*deviceCodeDefaultInterval)
+}
+
+func TestGetTokenFromDeviceErrors(t *testing.T) {
+	params := []struct {
+		name         string
+		authResponse string
+		grantError   string
+		err          string
+	}{
+		{"AccessDenied", testDeviceAuthResponse, "access_denied", errSignInDenied.Error()},
+		{"ExpiredToken", testDeviceAuthResponse, "expired_token", "device code expired before signing in"},
+		{"GrantError", testDeviceAuthResponse, "invalid_grant", "device token request failed: invalid_grant: "},
+		{"NotAllowed", `{"error":"invalid_client","error_description":"Invalid client type."}`, "", "device authorization not allowed: invalid_client: Invalid client type."},
+		{"AuthError", `{"error":"invalid_request","error_description":"Missing client_id."}`, "", "device authorization request failed: invalid_request: Missing client_id."},
+		{"NoDeviceCode", `{}`, "", "device authorization request failed: no device code in response"},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			s := newDeviceServer(t, param.authResponse, param.grantError)
+
+			_, err := getTokenFromDevice(context.Background(), http.DefaultClient, s.config, s.deviceAuthURL, io.Discard)
+
+			assert.EqualError(t, err, param.err)
+		})
+	}
+}
+
+func TestGetTokenFromDeviceTimeout(t *testing.T) {
+	s := newDeviceServer(t, testDeviceAuthResponse, "authorization_pending", "authorization_pending", "authorization_pending")
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Millisecond)
+	defer cancel()
+
+	_, err := getTokenFromDevice(ctx, http.DefaultClient, s.config, s.deviceAuthURL, io.Discard)
+
+	assert.EqualError(t, err, "device code expired before signing in")
+}
+
+func TestGetTokenWithoutBrowser(t *testing.T) {
+	s := newDeviceServer(t, testDeviceAuthResponse)
+
+	tok, err := getTokenWithoutBrowser(s.config, s.deviceAuthURL, nil, io.Discard)
+
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", tok.AccessToken)
+	require.Len(t, s.polls, 1)
+	assert.Equal(t, deviceCodeGrantType, s.polls[0].Get("grant_type"))
+}
+
+func TestGetTokenWithoutBrowserNotAllowed(t *testing.T) {
+	s := newDeviceServer(t, `{"error":"invalid_scope"}`)
+	in, out := promptPipes()
+
+	tok, err := getTokenWithoutBrowser(s.config, s.deviceAuthURL, in, out)
+
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", tok.AccessToken)
+	require.Len(t, s.polls, 1)
+	assert.Equal(t, "authorization_code", s.polls[0].Get("grant_type"))
+	assert.Equal(t, "auth-code", s.polls[0].Get("code"))
+}
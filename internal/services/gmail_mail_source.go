@@ -0,0 +1,422 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// gmailMailSource reads emails from Gmail through a cache. When gmailSrv is
+// nil it works offline using only the cache.
+type gmailMailSource struct {
+	gmailSrv *gmail.Service
+	cacheSrv CacheService
+	cfg      config.Config
+}
+
+func (s gmailMailSource) GetLabels(billNames ...string) (models.BillEmailLabels, error) {
+	labelNames, err := s.cfg.Labels(billNames)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := s.listLabels()
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("listed labels: %v", len(labels))
+	labelNameToLabel := make(map[string]*gmail.Label, len(labels))
+	for _, label := range labels {
+		labelNameToLabel[label.Name] = label
+	}
+
+	log.Debug("filtering listed labels")
+	result := make(models.BillEmailLabels, 0, len(labelNames))
+	for i := 0; i < len(labelNames); i++ {
+		if label, ok := labelNameToLabel[labelNames[i]]; ok {
+			billEmailLabel := models.BillEmailLabel{
+				BillName: billNames[i],
+				Label:    label,
+			}
+			result = append(result, billEmailLabel)
+		} else {
+			return nil, fmt.Errorf("label not found: %v", labelNames[i])
+		}
+	}
+	log.Debugf("filtered labels: %v", len(result))
+
+	return result, nil
+}
+
+// Search lists the emails having the label of the bill and matching its query
+// rules.
+func (s gmailMailSource) Search(billName string, period utils.Period) ([]string, error) {
+	billConfig, err := s.cfg.Bill(billName)
+	if err != nil {
+		return nil, err
+	}
+	if billConfig.Label == "" && !billConfig.HasRules() {
+		return nil, fmt.Errorf("no label or query rules configured for bill: %v", billName)
+	}
+
+	qs := make([]utils.Query, 0, 3)
+	if billConfig.Label != "" {
+		qs = append(qs, utils.Label(billConfig.Label))
+	}
+	qs = append(qs, utils.BillRulesQ(billConfig.From, billConfig.Subject, billConfig.HasAttachment, billConfig.Query...))
+	qs = append(qs, utils.WithinPeriodQ(period))
+	query := utils.And(qs...)
+	q, err := utils.Render(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query rules of bill: %v: %v", billName, err)
+	}
+	log.WithField("billName", billName).WithField("query", q).Info("listing emails from gmail")
+
+	return s.listMessageIds(q)
+}
+
+func (s gmailMailSource) Message(id string) (models.MailMessage, error) {
+	message, err := s.getMessage(id)
+	if err != nil {
+		return models.MailMessage{}, err
+	}
+
+	result := models.MailMessage{
+		Id:       message.Id,
+		Received: time.UnixMilli(message.InternalDate),
+	}
+	var walk func(part *gmail.MessagePart)
+	walk = func(part *gmail.MessagePart) {
+		if part == nil {
+			return
+		}
+		for _, header := range part.Headers {
+			switch {
+			case part == message.Payload && header.Name == "From":
+				result.From = header.Value
+			case part == message.Payload && header.Name == "Subject":
+				result.Subject = header.Value
+			}
+		}
+		if part.Filename != "" && part.Body != nil && part.Body.AttachmentId != "" {
+			result.Attachments = append(result.Attachments, models.Attachment{
+				Id:       part.Body.AttachmentId,
+				Filename: part.Filename,
+			})
+		}
+		for _, p := range part.Parts {
+			walk(p)
+		}
+	}
+	walk(message.Payload)
+
+	return result, nil
+}
+
+func (s gmailMailSource) Attachment(message models.MailMessage, attachment models.Attachment) ([]byte, error) {
+	return s.getAttachment(message.Id, attachment.Id)
+}
+
+// HistoryId returns the current history id of the mailbox.
+func (s gmailMailSource) HistoryId() (uint64, error) {
+	if s.gmailSrv == nil {
+		return 0, errors.New("gmail history is not available offline")
+	}
+
+	log.Info("getting mailbox history id from gmail")
+	profile, err := s.gmailSrv.Users.GetProfile(constants.GMAIL_USER).Do()
+	if err != nil {
+		return 0, err
+	}
+
+	return profile.HistoryId, nil
+}
+
+// NewMessages lists the emails that got the label of each bill after its start
+// history id. Only label based bills are supported, as Gmail history cannot be
+// queried using the query rules.
+func (s gmailMailSource) NewMessages(startHistoryIds map[string]uint64) (map[string][]string, uint64, error) {
+	if s.gmailSrv == nil {
+		return nil, 0, errors.New("gmail history is not available offline")
+	}
+
+	billNames := make([]string, 0, len(startHistoryIds))
+	var latestHistoryId uint64
+	for billName, startHistoryId := range startHistoryIds {
+		billConfig, err := s.cfg.Bill(billName)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !billConfig.IsLabelBased() {
+			return nil, 0, fmt.Errorf("sync supports only label based bills, bill: %v", billName)
+		}
+		billNames = append(billNames, billName)
+		if startHistoryId > latestHistoryId {
+			latestHistoryId = startHistoryId
+		}
+	}
+	result := make(map[string][]string, len(billNames))
+	if len(billNames) == 0 {
+		return result, latestHistoryId, nil
+	}
+	sort.Strings(billNames)
+
+	billEmailLabels, err := s.GetLabels(billNames...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, billEmailLabel := range billEmailLabels {
+		startHistoryId := startHistoryIds[billEmailLabel.BillName]
+		log.WithField("label", billEmailLabel.Name).
+			WithField("startHistoryId", startHistoryId).
+			Info("listing new emails from gmail history")
+		messageIds := make([]string, 0)
+		err := s.gmailSrv.Users.History.List(constants.GMAIL_USER).
+			StartHistoryId(startHistoryId).
+			LabelId(billEmailLabel.Id).
+			HistoryTypes("messageAdded", "labelAdded").
+			Pages(context.Background(), func(res *gmail.ListHistoryResponse) error {
+				if res.HistoryId > latestHistoryId {
+					latestHistoryId = res.HistoryId
+				}
+				for _, h := range res.History {
+					for _, added := range h.MessagesAdded {
+						messageIds = append(messageIds, added.Message.Id)
+					}
+					for _, added := range h.LabelsAdded {
+						messageIds = append(messageIds, added.Message.Id)
+					}
+				}
+				return nil
+			})
+		if isNotFound(err) {
+			return nil, 0, ErrHistoryExpired
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		log.WithField("label", billEmailLabel.Name).Debugf("listed new emails: %d", len(messageIds))
+		result[billEmailLabel.BillName] = messageIds
+	}
+
+	return result, latestHistoryId, nil
+}
+
+// MarkProcessed applies the processed label to the emails, creating the label
+// when required, and archives them when configured.
+func (s gmailMailSource) MarkProcessed(messageIds []string) error {
+	if len(messageIds) == 0 {
+		return nil
+	}
+	if s.gmailSrv == nil {
+		return errors.New("emails cannot be marked as processed offline")
+	}
+
+	labelId, err := s.getOrCreateLabel(s.cfg.ProcessedLabel)
+	if err != nil {
+		return err
+	}
+
+	req := &gmail.ModifyMessageRequest{AddLabelIds: []string{labelId}}
+	if s.cfg.ArchiveProcessed {
+		req.RemoveLabelIds = []string{"INBOX"}
+	}
+	for _, messageId := range messageIds {
+		log.WithField("messageId", messageId).
+			WithField("label", s.cfg.ProcessedLabel).
+			WithField("archive", s.cfg.ArchiveProcessed).
+			Info("marking email as processed")
+		_, err := s.gmailSrv.Users.Messages.Modify(constants.GMAIL_USER, messageId, req).Do()
+		if isForbidden(err) {
+			return fmt.Errorf("not permitted to modify emails, sign in again by running: sodexwoe auth login: %w", err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s gmailMailSource) getOrCreateLabel(name string) (string, error) {
+	labels, err := s.listLabels()
+	if err != nil {
+		return "", err
+	}
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Id, nil
+		}
+	}
+
+	log.WithField("label", name).Info("creating label in gmail")
+	label, err := s.gmailSrv.Users.Labels.Create(constants.GMAIL_USER, &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	}).Do()
+	if isForbidden(err) {
+		return "", fmt.Errorf("not permitted to create labels, sign in again by running: sodexwoe auth login: %w", err)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return label.Id, nil
+}
+
+func (s gmailMailSource) listLabels() ([]*gmail.Label, error) {
+	var labels []*gmail.Label
+	if s.gmailSrv == nil {
+		log.Info("listing labels from cache")
+		return labels, s.getCached(labelsCacheKey, &labels)
+	}
+
+	log.Info("listing labels from gmail")
+	labelsResponse, err := s.gmailSrv.Users.Labels.List(constants.GMAIL_USER).Do()
+	if err != nil {
+		return nil, err
+	}
+	s.putCached(labelsCacheKey, labelsResponse.Labels)
+
+	return labelsResponse.Labels, nil
+}
+
+// listMessageIds lists the ids of all the messages matching the query. The
+// result is cached only for working offline, as new emails could arrive.
+func (s gmailMailSource) listMessageIds(q string) ([]string, error) {
+	var messageIds []string
+	if s.gmailSrv == nil {
+		return messageIds, s.getCached(queryCacheKey(q), &messageIds)
+	}
+
+	err := s.gmailSrv.Users.Messages.List(constants.GMAIL_USER).Q(q).Pages(context.Background(), func(res *gmail.ListMessagesResponse) error {
+		for _, m := range res.Messages {
+			messageIds = append(messageIds, m.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.putCached(queryCacheKey(q), messageIds)
+
+	return messageIds, nil
+}
+
+func (s gmailMailSource) getMessage(messageId string) (*gmail.Message, error) {
+	var cachedMessage models.CachedMessage
+	if ok, err := s.cacheSrv.Get(messageCacheKey(messageId), &cachedMessage); err != nil {
+		return nil, err
+	} else if ok {
+		log.WithField("messageId", messageId).Debug("using email from cache")
+		return cachedMessage.Message, nil
+	}
+	if s.gmailSrv == nil {
+		return nil, fmt.Errorf("email not found in cache, messageId: %v", messageId)
+	}
+
+	log.WithField("messageId", messageId).Debug("fetching email")
+	message, err := s.gmailSrv.Users.Messages.Get(constants.GMAIL_USER, messageId).Do()
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%w, messageId: %v", ErrMessageNotFound, messageId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.putCached(messageCacheKey(messageId), models.CachedMessage{Message: message, Attachments: map[string]string{}})
+
+	return message, nil
+}
+
+func (s gmailMailSource) getAttachment(messageId, attachmentId string) ([]byte, error) {
+	var cachedMessage models.CachedMessage
+	if _, err := s.cacheSrv.Get(messageCacheKey(messageId), &cachedMessage); err != nil {
+		return nil, err
+	}
+	if hash, ok := cachedMessage.Attachments[attachmentId]; ok {
+		content, ok, err := s.cacheSrv.GetAttachment(hash)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			log.WithField("attachmentId", attachmentId).Debug("using attachment from cache")
+			return content, nil
+		}
+	}
+	if s.gmailSrv == nil {
+		return nil, fmt.Errorf("attachment not found in cache, messageId: %v", messageId)
+	}
+
+	log.WithField("attachmentId", attachmentId).Debug("fetching attachment")
+	attachmentRes, err := s.gmailSrv.Users.Messages.Attachments.Get(constants.GMAIL_USER, messageId, attachmentId).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("decoding attachment content")
+	content, err := base64.URLEncoding.DecodeString(attachmentRes.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := s.cacheSrv.PutAttachment(content)
+	if err != nil {
+		log.WithField("attachmentId", attachmentId).Warnf("failed to cache attachment: %v", err)
+		return content, nil
+	}
+	if cachedMessage.Message != nil {
+		if cachedMessage.Attachments == nil {
+			cachedMessage.Attachments = map[string]string{}
+		}
+		cachedMessage.Attachments[attachmentId] = hash
+		s.putCached(messageCacheKey(messageId), cachedMessage)
+	}
+
+	return content, nil
+}
+
+func (s gmailMailSource) getCached(key string, v interface{}) error {
+	ok, err := s.cacheSrv.Get(key, v)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("not found in cache, run once without --offline: %v", key)
+	}
+	return nil
+}
+
+// putCached caches v, only logging failures as the cache is an optimisation.
+func (s gmailMailSource) putCached(key string, v interface{}) {
+	if err := s.cacheSrv.Put(key, v); err != nil {
+		log.WithField("key", key).Warnf("failed to write cache: %v", err)
+	}
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+func isForbidden(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden
+}
+
+func NewGmailMailSource(gmailSrv *gmail.Service, cacheSrv CacheService, cfg config.Config) MailSource {
+	return gmailMailSource{gmailSrv, cacheSrv, cfg}
+}
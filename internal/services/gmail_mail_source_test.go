@@ -0,0 +1,191 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/arunvelsriram/sodexwoe/internal/testutils"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var april = time.Date(2024, time.April, 10, 10, 0, 0, 0, time.UTC)
+
+func newGmailTestServer(t *testing.T) *testutils.GmailServer {
+	server := testutils.NewGmailServer(t)
+	server.PageSize = 1
+	server.AddMessage(testutils.GmailMessage{
+		Id:          "airtel-april",
+		From:        "Airtel <ebill@airtel.com>",
+		Subject:     "Airtel bill",
+		Received:    april,
+		Attachments: []testutils.GmailAttachment{{Filename: "airtel.pdf", Data: []byte("airtel bill")}},
+	}, "Bills/Airtel")
+	server.AddMessage(testutils.GmailMessage{
+		Id:       "airtel-reminder",
+		From:     "Airtel <ebill@airtel.com>",
+		Subject:  "Pay your bill",
+		Received: april.Add(time.Hour),
+	}, "Bills/Airtel")
+	server.AddMessage(testutils.GmailMessage{
+		Id:          "airtel-march",
+		From:        "Airtel <ebill@airtel.com>",
+		Subject:     "Airtel bill",
+		Received:    april.AddDate(0, -1, 0),
+		Attachments: []testutils.GmailAttachment{{Filename: "airtel-march.pdf", Data: []byte("airtel march bill")}},
+	}, "Bills/Airtel")
+	server.AddMessage(testutils.GmailMessage{
+		Id:          "act-april",
+		From:        "ebill@actcorp.in",
+		Subject:     "Your ACT bill",
+		Received:    april,
+		Attachments: []testutils.GmailAttachment{{Filename: "act.pdf", Data: []byte("act bill")}},
+	})
+	return server
+}
+
+func TestGmailMailSourceGetEmails(t *testing.T) {
+	server := newGmailTestServer(t)
+	cfg := config.Config{
+		BillConfigs: config.BillConfigs{
+			"airtel": {Label: "Bills/Airtel"},
+			"act":    {From: "ebill@actcorp.in", HasAttachment: true},
+		},
+	}
+	mailSrc := services.NewGmailMailSource(server.Service(t), services.NewCacheService(t.TempDir()), cfg)
+	period := utils.MonthPeriod(2024, time.April, time.UTC)
+
+	emails, skipped, err := services.NewBillEmailService(mailSrc, cfg).GetEmails([]string{"airtel", "act"}, period, false)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"label:bills-airtel (after:1711929599 before:1714521600)",
+		"(from:\"ebill@actcorp.in\" has:attachment) (after:1711929599 before:1714521600)",
+	}, server.Queries)
+	assert.Equal(t, models.BillEmails{
+		{MessageId: "airtel-april", BillName: "airtel", Year: 2024, Month: time.April, Bill: models.Bill{Filename: "airtel.pdf", Data: []byte("airtel bill")}},
+		{MessageId: "act-april", BillName: "act", Year: 2024, Month: time.April, Bill: models.Bill{Filename: "act.pdf", Data: []byte("act bill")}},
+	}, emails)
+	assert.Equal(t, models.SkippedEmails{{MessageId: "airtel-reminder", BillName: "airtel", Reason: "no attachment found in email"}}, skipped)
+}
+
+func TestGmailMailSourceGetEmailsStrict(t *testing.T) {
+	server := newGmailTestServer(t)
+	cfg := config.Config{BillConfigs: config.BillConfigs{"airtel": {Label: "Bills/Airtel"}}}
+	mailSrc := services.NewGmailMailSource(server.Service(t), services.NewCacheService(t.TempDir()), cfg)
+
+	_, _, err := services.NewBillEmailService(mailSrc, cfg).GetEmails([]string{"airtel"}, utils.MonthPeriod(2024, time.April, time.UTC), true)
+
+	assert.EqualError(t, err, "no attachment found in email, messageId: airtel-reminder")
+}
+
+func TestGmailMailSourceGetEmailsMatchingMoreThanOneBill(t *testing.T) {
+	server := newGmailTestServer(t)
+	cfg := config.Config{
+		BillConfigs: config.BillConfigs{
+			"airtel":   {Label: "Bills/Airtel"},
+			"postpaid": {From: "ebill@airtel.com", Subject: "airtel bill"},
+		},
+	}
+	mailSrc := services.NewGmailMailSource(server.Service(t), services.NewCacheService(t.TempDir()), cfg)
+
+	emails, skipped, err := services.NewBillEmailService(mailSrc, cfg).GetEmails([]string{"airtel", "postpaid"}, utils.MonthPeriod(2024, time.April, time.UTC), false)
+
+	require.NoError(t, err)
+	require.Len(t, emails, 1)
+	assert.Equal(t, "airtel", emails[0].BillName)
+	assert.Contains(t, skipped, models.SkippedEmail{MessageId: "airtel-april", BillName: "postpaid", Reason: "email already attributed to bill: airtel"})
+}
+
+func TestGmailMailSourceOffline(t *testing.T) {
+	server := newGmailTestServer(t)
+	cfg := config.Config{BillConfigs: config.BillConfigs{"airtel": {Label: "Bills/Airtel"}}}
+	cacheSrv := services.NewCacheService(t.TempDir())
+	period := utils.MonthPeriod(2024, time.April, time.UTC)
+	online, _, err := services.NewBillEmailService(services.NewGmailMailSource(server.Service(t), cacheSrv, cfg), cfg).GetEmails([]string{"airtel"}, period, false)
+	require.NoError(t, err)
+	server.Close()
+
+	offline, skipped, err := services.NewBillEmailService(services.NewGmailMailSource(nil, cacheSrv, cfg), cfg).GetEmails([]string{"airtel"}, period, false)
+
+	require.NoError(t, err)
+	assert.Equal(t, online, offline)
+	assert.Len(t, skipped, 1)
+}
+
+func TestGmailMailSourceMarkProcessed(t *testing.T) {
+	server := newGmailTestServer(t)
+	cfg := config.Config{
+		ProcessedLabel:   "sodexwoe/processed",
+		ArchiveProcessed: true,
+		BillConfigs:      config.BillConfigs{"airtel": {Label: "Bills/Airtel"}},
+	}
+	billEmailSrv := services.NewBillEmailService(services.NewGmailMailSource(server.Service(t), services.NewCacheService(t.TempDir()), cfg), cfg)
+
+	err := billEmailSrv.MarkProcessed(models.BillEmails{{MessageId: "airtel-april"}})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bills/Airtel", "sodexwoe/processed"}, server.LabelNames("airtel-april"))
+	assert.Equal(t, []string{"Bills/Airtel", "INBOX"}, server.LabelNames("airtel-march"))
+}
+
+func TestGmailMailSourceMarkProcessedForbidden(t *testing.T) {
+	server := newGmailTestServer(t)
+	server.ForbidModifies()
+	cfg := config.Config{ProcessedLabel: "sodexwoe/processed", BillConfigs: config.BillConfigs{"airtel": {Label: "Bills/Airtel"}}}
+	billEmailSrv := services.NewBillEmailService(services.NewGmailMailSource(server.Service(t), services.NewCacheService(t.TempDir()), cfg), cfg)
+
+	err := billEmailSrv.MarkProcessed(models.BillEmails{{MessageId: "airtel-april"}})
+
+	assert.ErrorContains(t, err, "not permitted to create labels")
+}
+
+func TestGmailMailSourceGetNewEmails(t *testing.T) {
+	server := newGmailTestServer(t)
+	cfg := config.Config{
+		Timezone:    "UTC",
+		BillConfigs: config.BillConfigs{"airtel": {Label: "Bills/Airtel", PeriodOffset: -1}},
+	}
+	billEmailSrv := services.NewBillEmailService(services.NewGmailMailSource(server.Service(t), services.NewCacheService(t.TempDir()), cfg), cfg)
+	historyId, err := billEmailSrv.GetHistoryId()
+	require.NoError(t, err)
+	server.AddMessage(testutils.GmailMessage{
+		Id:          "airtel-may",
+		From:        "ebill@airtel.com",
+		Received:    april.AddDate(0, 1, 0),
+		Attachments: []testutils.GmailAttachment{{Filename: "airtel-may.pdf", Data: []byte("airtel may bill")}},
+	}, "Bills/Airtel")
+	server.AddMessage(testutils.GmailMessage{Id: "other", Received: april.AddDate(0, 1, 0)})
+
+	emails, skipped, nextHistoryId, err := billEmailSrv.GetNewEmails(map[string]uint64{"airtel": historyId}, false)
+
+	require.NoError(t, err)
+	assert.Equal(t, models.BillEmails{{
+		MessageId: "airtel-may",
+		BillName:  "airtel",
+		Year:      2024,
+		Month:     time.April,
+		Bill:      models.Bill{Filename: "airtel-may.pdf", Data: []byte("airtel may bill")},
+	}}, emails)
+	assert.Empty(t, skipped)
+	assert.Equal(t, historyId+2, nextHistoryId)
+
+	server.ExpireHistory()
+	_, _, _, err = billEmailSrv.GetNewEmails(map[string]uint64{"airtel": nextHistoryId}, false)
+
+	assert.ErrorIs(t, err, services.ErrHistoryExpired)
+}
+
+func TestGmailMailSourceGetNewEmailsRuleBasedBill(t *testing.T) {
+	server := newGmailTestServer(t)
+	cfg := config.Config{BillConfigs: config.BillConfigs{"act": {From: "ebill@actcorp.in"}}}
+	billEmailSrv := services.NewBillEmailService(services.NewGmailMailSource(server.Service(t), services.NewCacheService(t.TempDir()), cfg), cfg)
+
+	_, _, _, err := billEmailSrv.GetNewEmails(map[string]uint64{"act": 1}, false)
+
+	assert.EqualError(t, err, "sync supports only label based bills, bill: act")
+}
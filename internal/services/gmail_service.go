@@ -2,9 +2,9 @@ package services
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -13,166 +13,125 @@ import (
 
 	"github.com/arunvelsriram/sodexwoe/internal/constants"
 	"github.com/mitchellh/go-homedir"
-	"github.com/pkg/browser"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
 )
 
+// googleDeviceAuthURL is the device authorization endpoint of Google, usable
+// only by clients of the TVs and Limited Input devices type.
+const googleDeviceAuthURL = "https://oauth2.googleapis.com/device/code"
+
+// GoogleAccount is a Google account having its own token file. Name is empty
+// for the default account.
+type GoogleAccount struct {
+	Name string
+	// Email is suggested as the account to sign in to, when known, and is
+	// impersonated when using a service account key.
+	Email string
+}
+
 // Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) (*http.Client, error) {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	homeDir, err := homedir.Dir()
+// Without a browser, the user signs in on another device.
+func getClient(config *oauth2.Config, tokenStore TokenStore, account GoogleAccount, noBrowser bool) (*http.Client, error) {
+	tokFile, err := googleTokenFile(account)
 	if err != nil {
-		log.Debug("unable to identify the home directory")
 		return nil, err
 	}
-	tokFile := filepath.Join(homeDir, constants.GOOGLE_TOKEN_FILE)
-	log.WithField("tokenFile", tokFile).Debug("trying to use token from file")
-	tok, err := tokenFromFile(tokFile)
-	if err != nil {
-		log.WithField("tokenFile", tokFile).Info("token file not found so getting token from web")
-		tok, err := getTokenFromWeb(config)
-		if err != nil {
-			log.Debug("failed to get token from web")
-			return nil, err
-		}
 
-		log.WithField("tokenFile", tokFile).Info("saving token in file")
-		err = saveToken(tokFile, tok)
-		if err != nil {
-			log.Debug("failed to save the token")
-			return nil, err
-		}
+	return newTokenClient(config, tokenStore, tokFile, config.Scopes, googleAuthorize(config, account, noBrowser))
+}
 
-		return config.Client(context.Background(), tok), nil
+// googleTokenFile returns the path of the file storing the account's access
+// and refresh tokens, which is created automatically when the authorization
+// flow completes for the first time.
+func googleTokenFile(account GoogleAccount) (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		log.Debug("unable to identify the home directory")
+		return "", err
 	}
 
-	log.WithField("tokenFile", tokFile).Info("used token from file")
-
-	return config.Client(context.Background(), tok), nil
+	if account.Name == "" {
+		return filepath.Join(homeDir, constants.GOOGLE_TOKEN_FILE), nil
+	}
+	return filepath.Join(homeDir, fmt.Sprintf(constants.GOOGLE_ACCOUNT_TOKEN_FILE, account.Name)), nil
 }
 
-func getAuthCode() (string, error) {
-	type authCodeResponseHolder struct {
-		authCode string
-		err      error
+// googleAuthorize returns how the user signs in to the Google account, using
+// a browser unless noBrowser is set.
+func googleAuthorize(config *oauth2.Config, account GoogleAccount, noBrowser bool) authorizeFunc {
+	opts := make([]oauth2.AuthCodeOption, 0, 1)
+	if account.Email != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", account.Email))
 	}
-	ch := make(chan authCodeResponseHolder)
-
-	addr := "localhost:7080"
-	server := http.Server{Addr: addr}
-
-	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("pong"))
-	})
-
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		log.Debug("got callback")
-		var authCodeRes authCodeResponseHolder
-		q := r.URL.Query()
-		if q.Has("code") {
-			log.Debug("callback has code in query params")
-			authCodeRes = authCodeResponseHolder{authCode: q.Get("code"), err: nil}
-		} else {
-			log.Debug("unable to get auth code from query params")
-			authCodeRes = authCodeResponseHolder{err: fmt.Errorf("unable to get auth code from query params: %v", q)}
+
+	return func() (*oauth2.Token, error) {
+		if account.Name != "" {
+			log.WithField("account", account.Name).WithField("email", account.Email).Info("signing in to google account")
 		}
-		w.Write([]byte("you may close this tab now!"))
-		ch <- authCodeRes
-	})
-
-	go func() {
-		log.WithField("addr", addr).Info("starting server")
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			log.WithField("addr", addr).Debug("failed to start server")
-			ch <- authCodeResponseHolder{err: fmt.Errorf("failed to start server: %v", err)}
+		if noBrowser {
+			log.Info("signing in without a browser")
+			return getTokenWithoutBrowser(config, googleDeviceAuthURL, os.Stdin, os.Stdout, opts...)
 		}
-	}()
-
-	a := <-ch
-
-	log.WithField("addr", addr).Info("shutting down the server")
-	if err := server.Shutdown(context.Background()); err != nil {
-		log.WithField("addr", addr).Debug("failed to shutdown server")
-		return "", fmt.Errorf("failed to shutdown server: %v", err)
+		log.Info("getting token from web")
+		return getTokenFromWeb(config, opts...)
 	}
-
-	return a.authCode, a.err
 }
 
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	log.Infof("Opening Auth URL: %v", authURL)
-	if err := browser.OpenURL(authURL); err != nil {
-		log.WithField("authURL", authURL).Debug("failed to open URL in browser")
-		return nil, err
-	}
-
-	authCode, err := getAuthCode()
-	if err != nil {
-		log.Debugf("unable to get authCode")
-		return nil, err
+// googleConfig returns the OAuth config of the Google API client for the
+// scopes, from the credentials of the client in the client_secret.json format.
+func googleConfig(credentials []byte, scopes ...string) (*oauth2.Config, error) {
+	if isServiceAccountKey(credentials) {
+		return nil, errServiceAccountSignIn
 	}
-
-	tok, err := config.Exchange(context.TODO(), authCode)
+	config, err := google.ConfigFromJSON(credentials, scopes...)
 	if err != nil {
-		log.Debugf("Unable to retrieve token from web")
-		return nil, err
+		log.Debug("failed get config from JSON")
+		return nil, fmt.Errorf("invalid Google API credentials: %v", err)
 	}
 
-	return tok, nil
-}
-
-// Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		log.WithField("file", file).Debugf("failed to get token from file")
-		return nil, err
-	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
+	return config, nil
 }
 
-// Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) error {
-	log.WithField("path", path).Info("saving credential file")
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Debug("unable to cache oauth token")
-		return err
+// getTokenWithoutBrowser signs in using a device code when the client is
+// allowed to, or else using the code of the redirect URL pasted by the user
+// after signing in using a browser on any device.
+func getTokenWithoutBrowser(config *oauth2.Config, deviceAuthURL string, in io.Reader, out io.Writer, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	tok, err := getTokenFromDevice(context.Background(), http.DefaultClient, config, deviceAuthURL, out)
+	if !errors.Is(err, errDeviceAuthNotAllowed) {
+		return tok, err
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	log.WithField("reason", err).Info("unable to sign in using a device code so signing in using the redirect URL")
 
-	return nil
+	return getTokenFromPrompt(config, in, out, opts...)
 }
 
-func NewGmailService(googleAPICredentials string) (*gmail.Service, error) {
-	b, err := base64.StdEncoding.DecodeString(googleAPICredentials)
-	if err != nil {
-		log.Debug("failed to deocde Google API credentials")
-		return nil, err
-	}
-
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
-	if err != nil {
-		log.Debug("failed get config from JSON")
-		return nil, err
-	}
+// NewGmailService creates a Gmail service of the account authorized for the
+// given scopes, saving its token in the token store. Without a browser, the
+// user signs in on another device the first time. With a service account key,
+// the email of the account is impersonated instead of signing in.
+func NewGmailService(credentials []byte, tokenStore TokenStore, account GoogleAccount, noBrowser bool, scopes ...string) (*gmail.Service, error) {
+	var httpClient *http.Client
+	if isServiceAccountKey(credentials) {
+		client, err := serviceAccountClient(credentials, account, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		httpClient = client
+	} else {
+		config, err := googleConfig(credentials, scopes...)
+		if err != nil {
+			return nil, err
+		}
 
-	httpClient, err := getClient(config)
-	if err != nil {
-		log.Debug("failed crreate gmail client")
-		return nil, err
+		client, err := getClient(config, tokenStore, account, noBrowser)
+		if err != nil {
+			log.Debug("failed crreate gmail client")
+			return nil, err
+		}
+		httpClient = client
 	}
 
 	srv, err := gmail.NewService(context.Background(), option.WithHTTPClient(httpClient))
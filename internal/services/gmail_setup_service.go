@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// gmailBatchModifyLimit is the maximum number of emails that can be modified
+// in a single request.
+const gmailBatchModifyLimit = 1000
+
+type GmailSetupService interface {
+	Setup(billNames []string, backApply bool) (models.GmailSetupResults, error)
+}
+
+type gmailSetupService struct {
+	gmailSrv *gmail.Service
+	cfg      config.Config
+}
+
+// Setup creates the missing labels of the bills and filters applying them to
+// new emails matching the sender/subject rules of the bills. With backApply,
+// the labels are applied to the existing emails matching the rules too.
+func (s gmailSetupService) Setup(billNames []string, backApply bool) (models.GmailSetupResults, error) {
+	labelsRes, err := s.gmailSrv.Users.Labels.List(constants.GMAIL_USER).Do()
+	if err != nil {
+		return nil, setupError(err)
+	}
+	labelIds := make(map[string]string, len(labelsRes.Labels))
+	for _, label := range labelsRes.Labels {
+		labelIds[label.Name] = label.Id
+	}
+	filtersRes, err := s.gmailSrv.Users.Settings.Filters.List(constants.GMAIL_USER).Do()
+	if err != nil {
+		return nil, setupError(err)
+	}
+
+	result := make(models.GmailSetupResults, 0, len(billNames))
+	for _, billName := range billNames {
+		billConfig, err := s.cfg.Bill(billName)
+		if err != nil {
+			return nil, err
+		}
+		setupResult := models.GmailSetupResult{BillName: billName, Label: billConfig.Label}
+		if billConfig.Label == "" {
+			setupResult.Note = "no label configured"
+			result = append(result, setupResult)
+			continue
+		}
+
+		labelId, ok := labelIds[billConfig.Label]
+		if !ok {
+			log.WithField("label", billConfig.Label).Info("creating label in gmail")
+			label, err := s.gmailSrv.Users.Labels.Create(constants.GMAIL_USER, &gmail.Label{
+				Name:                  billConfig.Label,
+				LabelListVisibility:   "labelShow",
+				MessageListVisibility: "show",
+			}).Do()
+			if err != nil {
+				return nil, setupError(err)
+			}
+			labelId = label.Id
+			labelIds[label.Name] = label.Id
+			setupResult.LabelCreated = true
+		}
+
+		if !billConfig.HasRules() {
+			setupResult.Note = "no sender/subject rules to create a filter"
+			result = append(result, setupResult)
+			continue
+		}
+
+		criteria := filterCriteria(billConfig)
+		if !hasFilter(filtersRes.Filter, criteria, labelId) {
+			log.WithField("billName", billName).WithField("label", billConfig.Label).Info("creating filter in gmail")
+			filter, err := s.gmailSrv.Users.Settings.Filters.Create(constants.GMAIL_USER, &gmail.Filter{
+				Criteria: criteria,
+				Action:   &gmail.FilterAction{AddLabelIds: []string{labelId}},
+			}).Do()
+			if err != nil {
+				return nil, setupError(err)
+			}
+			filtersRes.Filter = append(filtersRes.Filter, filter)
+			setupResult.FilterCreated = true
+		}
+
+		if backApply {
+			if setupResult.LabelledEmails, err = s.applyLabel(billConfig, labelId); err != nil {
+				return nil, setupError(err)
+			}
+		}
+		result = append(result, setupResult)
+	}
+
+	return result, nil
+}
+
+// applyLabel applies the label to the existing emails matching the rules of
+// the bill, returning the number of emails labelled.
+func (s gmailSetupService) applyLabel(billConfig config.BillConfig, labelId string) (int, error) {
+	query := utils.And(
+		utils.BillRulesQ(billConfig.From, billConfig.Subject, billConfig.HasAttachment, billConfig.Query...),
+		utils.Not(utils.Label(billConfig.Label)),
+	)
+	q, err := utils.Render(query)
+	if err != nil {
+		return 0, err
+	}
+	log.WithField("query", q).Info("listing existing emails to label")
+	messageIds := make([]string, 0)
+	err = s.gmailSrv.Users.Messages.List(constants.GMAIL_USER).Q(q).Pages(context.Background(), func(res *gmail.ListMessagesResponse) error {
+		for _, message := range res.Messages {
+			messageIds = append(messageIds, message.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for start := 0; start < len(messageIds); start += gmailBatchModifyLimit {
+		end := start + gmailBatchModifyLimit
+		if end > len(messageIds) {
+			end = len(messageIds)
+		}
+		log.WithField("label", billConfig.Label).Infof("labelling existing emails: %d", end-start)
+		err := s.gmailSrv.Users.Messages.BatchModify(constants.GMAIL_USER, &gmail.BatchModifyMessagesRequest{
+			Ids:         messageIds[start:end],
+			AddLabelIds: []string{labelId},
+		}).Do()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(messageIds), nil
+}
+
+func filterCriteria(billConfig config.BillConfig) *gmail.FilterCriteria {
+	return &gmail.FilterCriteria{
+		From:          billConfig.From,
+		Subject:       billConfig.Subject,
+		HasAttachment: billConfig.HasAttachment,
+		Query:         strings.Join(billConfig.Query, " "),
+	}
+}
+
+// hasFilter reports whether any of the filters has the criteria and applies
+// the label.
+func hasFilter(filters []*gmail.Filter, criteria *gmail.FilterCriteria, labelId string) bool {
+	for _, filter := range filters {
+		if filter.Criteria == nil || filter.Action == nil {
+			continue
+		}
+		c := filter.Criteria
+		if c.From != criteria.From || c.Subject != criteria.Subject || c.HasAttachment != criteria.HasAttachment || c.Query != criteria.Query {
+			continue
+		}
+		for _, id := range filter.Action.AddLabelIds {
+			if id == labelId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func setupError(err error) error {
+	if isForbidden(err) {
+		return fmt.Errorf("not permitted to manage labels and filters, sign in again by running: sodexwoe auth login: %w", err)
+	}
+	return err
+}
+
+// NewGmailSetupService creates a service to set up Gmail, which needs the
+// gmail.modify and gmail.settings.basic scopes.
+func NewGmailSetupService(gmailSrv *gmail.Service, cfg config.Config) GmailSetupService {
+	return gmailSetupService{gmailSrv, cfg}
+}
@@ -0,0 +1,86 @@
+package services_test
+
+import (
+	"testing"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/arunvelsriram/sodexwoe/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+)
+
+var setupConfig = config.Config{
+	BillConfigs: config.BillConfigs{
+		"airtel":  {Label: "Bills/Airtel", From: "ebill@airtel.com", Subject: "Airtel bill"},
+		"act":     {Label: "Bills/ACT", From: "ebill@actcorp.in", HasAttachment: true},
+		"jio":     {From: "jio@jio.com"},
+		"tatasky": {Label: "Bills/Tata Sky"},
+	},
+}
+
+func TestGmailSetupServiceSetup(t *testing.T) {
+	server := newGmailTestServer(t)
+	setupSrv := services.NewGmailSetupService(server.Service(t), setupConfig)
+
+	results, err := setupSrv.Setup([]string{"airtel", "act", "jio", "tatasky"}, false)
+
+	require.NoError(t, err)
+	assert.Equal(t, models.GmailSetupResults{
+		{BillName: "airtel", Label: "Bills/Airtel", FilterCreated: true},
+		{BillName: "act", Label: "Bills/ACT", LabelCreated: true, FilterCreated: true},
+		{BillName: "jio", Note: "no label configured"},
+		{BillName: "tatasky", Label: "Bills/Tata Sky", LabelCreated: true, Note: "no sender/subject rules to create a filter"},
+	}, results)
+	filters := server.Filters()
+	require.Len(t, filters, 2)
+	assert.Equal(t, &gmail.FilterCriteria{From: "ebill@airtel.com", Subject: "Airtel bill"}, filters[0].Criteria)
+	assert.Equal(t, &gmail.FilterCriteria{From: "ebill@actcorp.in", HasAttachment: true}, filters[1].Criteria)
+	assert.Equal(t, []string{"INBOX"}, server.LabelNames("act-april"))
+
+	results, err = setupSrv.Setup([]string{"airtel", "act"}, false)
+
+	require.NoError(t, err)
+	assert.Equal(t, models.GmailSetupResults{
+		{BillName: "airtel", Label: "Bills/Airtel"},
+		{BillName: "act", Label: "Bills/ACT"},
+	}, results)
+	assert.Len(t, server.Filters(), 2)
+}
+
+func TestGmailSetupServiceSetupBackApply(t *testing.T) {
+	server := newGmailTestServer(t)
+	setupSrv := services.NewGmailSetupService(server.Service(t), setupConfig)
+
+	results, err := setupSrv.Setup([]string{"airtel", "act"}, true)
+
+	require.NoError(t, err)
+	assert.Equal(t, models.GmailSetupResults{
+		{BillName: "airtel", Label: "Bills/Airtel", FilterCreated: true},
+		{BillName: "act", Label: "Bills/ACT", LabelCreated: true, FilterCreated: true, LabelledEmails: 1},
+	}, results)
+	assert.Equal(t, []string{"Bills/ACT", "INBOX"}, server.LabelNames("act-april"))
+}
+
+func TestGmailSetupServiceSetupForbidden(t *testing.T) {
+	params := []struct {
+		name   string
+		forbid func(*testutils.GmailServer)
+	}{
+		{"Modifies", (*testutils.GmailServer).ForbidModifies},
+		{"ListLabels", (*testutils.GmailServer).ForbidAll},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			server := newGmailTestServer(t)
+			param.forbid(server)
+
+			_, err := services.NewGmailSetupService(server.Service(t), setupConfig).Setup([]string{"act"}, false)
+
+			assert.ErrorContains(t, err, "not permitted to manage labels and filters")
+		})
+	}
+}
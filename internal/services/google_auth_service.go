@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// googleRevokeURL is the token revocation endpoint of Google.
+const googleRevokeURL = "https://oauth2.googleapis.com/revoke"
+
+// ErrNotSignedIn is returned when there is no saved token.
+var ErrNotSignedIn = errors.New("not signed in, run: sodexwoe auth login")
+
+// GoogleEndpoints are the URLs of the Google APIs used to manage the sign in,
+// each defaulting to that of Google when empty.
+type GoogleEndpoints struct {
+	Gmail  string
+	Revoke string
+}
+
+func (e GoogleEndpoints) revokeURL() string {
+	if e.Revoke == "" {
+		return googleRevokeURL
+	}
+	return e.Revoke
+}
+
+type GoogleAuthService interface {
+	Login(scopes ...string) error
+	Status() (models.AuthStatus, error)
+	Logout() error
+	Revoke() error
+}
+
+type googleAuthService struct {
+	credentials []byte
+	tokenStore  TokenStore
+	account     GoogleAccount
+	noBrowser   bool
+	endpoints   GoogleEndpoints
+}
+
+// Login signs in to Google for the scopes, replacing the saved token.
+func (s googleAuthService) Login(scopes ...string) error {
+	config, err := googleConfig(s.credentials, scopes...)
+	if err != nil {
+		return err
+	}
+	tokFile, err := googleTokenFile(s.account)
+	if err != nil {
+		return err
+	}
+
+	ts := &persistingTokenSource{config: config, store: s.tokenStore, path: tokFile, authorize: googleAuthorize(config, s.account, s.noBrowser)}
+	return ts.reauthorize()
+}
+
+// Status returns the account and the scopes of the saved token, refreshing
+// it when it has expired. It does not sign in when the token is not valid.
+func (s googleAuthService) Status() (models.AuthStatus, error) {
+	config, err := googleConfig(s.credentials)
+	if err != nil {
+		return models.AuthStatus{}, err
+	}
+	tokFile, err := googleTokenFile(s.account)
+	if err != nil {
+		return models.AuthStatus{}, err
+	}
+	if _, err := s.tokenStore.Load(tokFile); errors.Is(err, fs.ErrNotExist) {
+		return models.AuthStatus{}, ErrNotSignedIn
+	} else if err != nil {
+		return models.AuthStatus{}, err
+	}
+
+	httpClient, err := newTokenClient(config, s.tokenStore, tokFile, nil, func() (*oauth2.Token, error) {
+		return nil, errors.New("saved token is no longer valid, run: sodexwoe auth login")
+	})
+	if err != nil {
+		return models.AuthStatus{}, err
+	}
+	opts := []option.ClientOption{option.WithHTTPClient(httpClient)}
+	if s.endpoints.Gmail != "" {
+		opts = append(opts, option.WithEndpoint(s.endpoints.Gmail))
+	}
+	srv, err := gmail.NewService(context.Background(), opts...)
+	if err != nil {
+		return models.AuthStatus{}, err
+	}
+	profile, err := srv.Users.GetProfile(constants.GMAIL_USER).Do()
+	if err != nil {
+		return models.AuthStatus{}, err
+	}
+
+	stored, err := loadToken(s.tokenStore, tokFile)
+	if err != nil {
+		return models.AuthStatus{}, err
+	}
+	return models.AuthStatus{Email: profile.EmailAddress, Scopes: stored.Scopes, Expiry: stored.Expiry, TokenLocation: s.tokenStore.Location(tokFile)}, nil
+}
+
+// Logout deletes the saved token.
+func (s googleAuthService) Logout() error {
+	tokFile, err := googleTokenFile(s.account)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("tokenFile", tokFile).Info("deleting token")
+	if err := s.tokenStore.Delete(tokFile); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotSignedIn
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Revoke revokes the access granted to the saved token and deletes it.
+func (s googleAuthService) Revoke() error {
+	tokFile, err := googleTokenFile(s.account)
+	if err != nil {
+		return err
+	}
+	stored, err := loadToken(s.tokenStore, tokFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotSignedIn
+	}
+	if err != nil {
+		return err
+	}
+
+	// Revoking the refresh token revokes the access tokens issued for it too.
+	token := stored.RefreshToken
+	if token == "" {
+		token = stored.AccessToken
+	}
+	log.Info("revoking token")
+	res, err := http.PostForm(s.endpoints.revokeURL(), url.Values{"token": {token}})
+	if err != nil {
+		return fmt.Errorf("unable to revoke token: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var errRes struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(res.Body).Decode(&errRes) != nil || errRes.Error != "invalid_token" {
+			return fmt.Errorf("unable to revoke token: %v", res.Status)
+		}
+		log.Warn("token was already revoked or has expired")
+	}
+
+	return s.Logout()
+}
+
+// NewGoogleAuthService creates a service managing the token of the Google
+// account saved in the token store. Without a browser, the user signs in on
+// another device.
+func NewGoogleAuthService(credentials []byte, tokenStore TokenStore, account GoogleAccount, noBrowser bool, endpoints GoogleEndpoints) GoogleAuthService {
+	return googleAuthService{credentials, tokenStore, account, noBrowser, endpoints}
+}
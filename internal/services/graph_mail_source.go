@@ -0,0 +1,279 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	graphFileAttachment    = "#microsoft.graph.fileAttachment"
+	graphMessageFields     = "id,receivedDateTime,from,subject,hasAttachments"
+	graphAttachmentsFields = "id,name,contentType"
+	graphPageSize          = "50"
+)
+
+type graphEmailAddress struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type graphMessage struct {
+	Id               string    `json:"id"`
+	ReceivedDateTime time.Time `json:"receivedDateTime"`
+	Subject          string    `json:"subject"`
+	HasAttachments   bool      `json:"hasAttachments"`
+	From             struct {
+		EmailAddress graphEmailAddress `json:"emailAddress"`
+	} `json:"from"`
+}
+
+type graphAttachment struct {
+	Type         string `json:"@odata.type"`
+	Id           string `json:"id"`
+	Name         string `json:"name"`
+	ContentType  string `json:"contentType"`
+	ContentBytes []byte `json:"contentBytes"`
+}
+
+type graphMailFolder struct {
+	Id          string `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+type graphError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// graphMailSource reads emails from a Microsoft 365 mailbox using the
+// Microsoft Graph API. A bill is found in its mail folder, or by its category,
+// along with its sender and subject rules.
+type graphMailSource struct {
+	httpClient *http.Client
+	baseURL    string
+	cfg        config.Config
+	folderIds  map[string]string
+}
+
+// get requests the Graph API and decodes the JSON response into v. path may
+// also be an absolute next page link.
+func (s *graphMailSource) get(path string, query url.Values, v interface{}) error {
+	reqURL := path
+	if !strings.HasPrefix(path, "https://") && !strings.HasPrefix(path, "http://") {
+		reqURL = s.baseURL + path
+	}
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+
+	log.WithField("url", reqURL).Debug("requesting graph api")
+	res, err := s.httpClient.Get(reqURL)
+	if err != nil {
+		return fmt.Errorf("graph api request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrMessageNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		var graphErr graphError
+		body, _ := io.ReadAll(res.Body)
+		if err := json.Unmarshal(body, &graphErr); err == nil && graphErr.Error.Message != "" {
+			return fmt.Errorf("graph api request failed: %v: %v: %v", res.Status, graphErr.Error.Code, graphErr.Error.Message)
+		}
+		return fmt.Errorf("graph api request failed: %v", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("unable to decode graph api response: %v", err)
+	}
+	return nil
+}
+
+// list requests all pages of a Graph API collection, decoding each item using
+// add.
+func (s *graphMailSource) list(path string, query url.Values, add func(json.RawMessage) error) error {
+	for path != "" {
+		var page struct {
+			Value    []json.RawMessage `json:"value"`
+			NextLink string            `json:"@odata.nextLink"`
+		}
+		if err := s.get(path, query, &page); err != nil {
+			return err
+		}
+		for _, item := range page.Value {
+			if err := add(item); err != nil {
+				return err
+			}
+		}
+		// the next page link has the query already
+		path, query = page.NextLink, nil
+	}
+	return nil
+}
+
+// folderId resolves the id of a mail folder from its path of display names
+// like Inbox/Bills/Airtel.
+func (s *graphMailSource) folderId(folder string) (string, error) {
+	if id, ok := s.folderIds[folder]; ok {
+		return id, nil
+	}
+
+	path := "/me/mailFolders"
+	id := ""
+	for _, name := range strings.Split(folder, "/") {
+		found := false
+		err := s.list(path, url.Values{"$select": {"id,displayName"}}, func(item json.RawMessage) error {
+			var mailFolder graphMailFolder
+			if err := json.Unmarshal(item, &mailFolder); err != nil {
+				return err
+			}
+			if !found && strings.EqualFold(mailFolder.DisplayName, name) {
+				id, found = mailFolder.Id, true
+			}
+			return nil
+		})
+		if errors.Is(err, ErrMessageNotFound) || err == nil && !found {
+			return "", fmt.Errorf("mail folder not found: %v", folder)
+		}
+		if err != nil {
+			return "", err
+		}
+		path = "/me/mailFolders/" + url.PathEscape(id) + "/childFolders"
+	}
+	s.folderIds[folder] = id
+
+	return id, nil
+}
+
+// Search lists the emails of the bill received within the period, in its mail
+// folder or having its category. The sender and subject rules are matched as
+// substrings, as the Graph API can filter only on exact addresses.
+func (s *graphMailSource) Search(billName string, period utils.Period) ([]string, error) {
+	billConfig, err := s.cfg.Bill(billName)
+	if err != nil {
+		return nil, err
+	}
+	if len(billConfig.Query) > 0 {
+		return nil, fmt.Errorf("query rules are supported only with gmail, bill: %v", billName)
+	}
+	if billConfig.Folder == "" && billConfig.Category == "" && !billConfig.HasRules() {
+		return nil, fmt.Errorf("no folder, category or query rules configured for bill: %v", billName)
+	}
+
+	path := "/me/messages"
+	if billConfig.Folder != "" {
+		folderId, err := s.folderId(billConfig.Folder)
+		if err != nil {
+			return nil, err
+		}
+		path = "/me/mailFolders/" + url.PathEscape(folderId) + "/messages"
+	}
+	filters := []string{
+		fmt.Sprintf("receivedDateTime ge %v", period.Start.UTC().Format(time.RFC3339)),
+		fmt.Sprintf("receivedDateTime lt %v", period.End.UTC().Format(time.RFC3339)),
+	}
+	if billConfig.Category != "" {
+		filters = append(filters, fmt.Sprintf("categories/any(c:c eq '%v')", strings.ReplaceAll(billConfig.Category, "'", "''")))
+	}
+	if billConfig.HasAttachment {
+		filters = append(filters, "hasAttachments eq true")
+	}
+	query := url.Values{
+		"$filter": {strings.Join(filters, " and ")},
+		"$select": {graphMessageFields},
+		"$top":    {graphPageSize},
+	}
+
+	log.WithField("billName", billName).WithField("filter", query.Get("$filter")).Info("listing emails from graph api")
+	result := make([]string, 0)
+	err = s.list(path, query, func(item json.RawMessage) error {
+		var message graphMessage
+		if err := json.Unmarshal(item, &message); err != nil {
+			return err
+		}
+		from := strings.ToLower(message.From.EmailAddress.Name + " " + message.From.EmailAddress.Address)
+		if billConfig.From != "" && !strings.Contains(from, strings.ToLower(billConfig.From)) {
+			return nil
+		}
+		if billConfig.Subject != "" && !strings.Contains(strings.ToLower(message.Subject), strings.ToLower(billConfig.Subject)) {
+			return nil
+		}
+		result = append(result, message.Id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *graphMailSource) Message(id string) (models.MailMessage, error) {
+	log.WithField("messageId", id).Debug("fetching email")
+	path := "/me/messages/" + url.PathEscape(id)
+	var message graphMessage
+	if err := s.get(path, url.Values{"$select": {graphMessageFields}}, &message); err != nil {
+		if errors.Is(err, ErrMessageNotFound) {
+			return models.MailMessage{}, fmt.Errorf("%w, messageId: %v", ErrMessageNotFound, id)
+		}
+		return models.MailMessage{}, err
+	}
+
+	result := models.MailMessage{
+		Id:       message.Id,
+		From:     message.From.EmailAddress.Address,
+		Subject:  message.Subject,
+		Received: message.ReceivedDateTime,
+	}
+	if !message.HasAttachments {
+		return result, nil
+	}
+
+	err := s.list(path+"/attachments", url.Values{"$select": {graphAttachmentsFields}}, func(item json.RawMessage) error {
+		var attachment graphAttachment
+		if err := json.Unmarshal(item, &attachment); err != nil {
+			return err
+		}
+		// item and reference attachments have no content to download
+		if attachment.Type == graphFileAttachment {
+			result.Attachments = append(result.Attachments, models.Attachment{Id: attachment.Id, Filename: attachment.Name})
+		}
+		return nil
+	})
+	if err != nil {
+		return models.MailMessage{}, err
+	}
+
+	return result, nil
+}
+
+func (s *graphMailSource) Attachment(message models.MailMessage, attachment models.Attachment) ([]byte, error) {
+	log.WithField("messageId", message.Id).WithField("attachmentId", attachment.Id).Debug("fetching attachment")
+	var result graphAttachment
+	path := "/me/messages/" + url.PathEscape(message.Id) + "/attachments/" + url.PathEscape(attachment.Id)
+	if err := s.get(path, nil, &result); err != nil {
+		return nil, err
+	}
+
+	return result.ContentBytes, nil
+}
+
+// NewGraphMailSource creates a mail source that reads emails using the
+// Microsoft Graph API at baseURL, using an authorized HTTP client.
+func NewGraphMailSource(httpClient *http.Client, baseURL string, cfg config.Config) MailSource {
+	return &graphMailSource{httpClient: httpClient, baseURL: strings.TrimSuffix(baseURL, "/"), cfg: cfg, folderIds: make(map[string]string)}
+}
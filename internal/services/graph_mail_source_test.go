@@ -0,0 +1,134 @@
+package services_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func graphMessage(id, from, subject string, received time.Time, hasAttachments bool) map[string]interface{} {
+	return map[string]interface{}{
+		"id":               id,
+		"receivedDateTime": received.Format(time.RFC3339),
+		"subject":          subject,
+		"hasAttachments":   hasAttachments,
+		"from":             map[string]interface{}{"emailAddress": map[string]string{"name": "Billing", "address": from}},
+	}
+}
+
+// startGraphServer starts a fake Microsoft Graph API having an Inbox/Bills
+// mail folder with an Airtel bill, and an ACT bill having a category.
+func startGraphServer(t *testing.T) (*httptest.Server, *[]string) {
+	april := time.Date(2024, time.April, 10, 10, 0, 0, 0, time.UTC)
+	filters := make([]string, 0)
+	var server *httptest.Server
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/me/mailFolders", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"value": []map[string]string{
+			{"id": "archive-id", "displayName": "Archive"},
+			{"id": "inbox-id", "displayName": "Inbox"},
+		}})
+	})
+	mux.HandleFunc("/me/mailFolders/inbox-id/childFolders", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"value": []map[string]string{{"id": "bills-id", "displayName": "Bills"}}})
+	})
+	mux.HandleFunc("/me/mailFolders/bills-id/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			writeJSON(w, map[string]interface{}{"value": []interface{}{graphMessage("airtel-1", "ebill@airtel.com", "Airtel bill", april, true)}})
+			return
+		}
+		filters = append(filters, r.URL.Query().Get("$filter"))
+		writeJSON(w, map[string]interface{}{
+			"value":           []interface{}{graphMessage("offer-1", "offers@airtel.com", "Offers", april, true)},
+			"@odata.nextLink": server.URL + "/me/mailFolders/bills-id/messages?page=2",
+		})
+	})
+	mux.HandleFunc("/me/messages", func(w http.ResponseWriter, r *http.Request) {
+		filters = append(filters, r.URL.Query().Get("$filter"))
+		writeJSON(w, map[string]interface{}{"value": []interface{}{graphMessage("act-1", "ebill@actcorp.in", "Your ACT bill", april, true)}})
+	})
+	mux.HandleFunc("/me/messages/airtel-1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, graphMessage("airtel-1", "ebill@airtel.com", "Airtel bill", april, true))
+	})
+	mux.HandleFunc("/me/messages/airtel-1/attachments", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"value": []map[string]string{
+			{"@odata.type": "#microsoft.graph.itemAttachment", "id": "item-1", "name": "forwarded.pdf"},
+			{"@odata.type": "#microsoft.graph.fileAttachment", "id": "file-1", "name": "airtel.pdf", "contentType": "application/pdf"},
+		}})
+	})
+	mux.HandleFunc("/me/messages/airtel-1/attachments/file-1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"id": "file-1", "name": "airtel.pdf", "contentBytes": []byte("airtel bill")})
+	})
+	mux.HandleFunc("/me/messages/act-1", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]interface{}{"error": map[string]string{"code": "ErrorItemNotFound", "message": "not found"}})
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server, &filters
+}
+
+func TestGraphMailSourceGetEmails(t *testing.T) {
+	server, filters := startGraphServer(t)
+	cfg := config.Config{
+		BillConfigs: config.BillConfigs{
+			"airtel": {Folder: "inbox/bills", From: "ebill@airtel.com"},
+			"act":    {Category: "Bills", HasAttachment: true},
+		},
+	}
+	mailSrc := services.NewGraphMailSource(server.Client(), server.URL, cfg)
+	period := utils.MonthPeriod(2024, time.April, time.FixedZone("IST", 5*60*60+30*60))
+
+	emails, skipped, err := services.NewBillEmailService(mailSrc, cfg).GetEmails([]string{"airtel", "act"}, period, false)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"receivedDateTime ge 2024-03-31T18:30:00Z and receivedDateTime lt 2024-04-30T18:30:00Z",
+		"receivedDateTime ge 2024-03-31T18:30:00Z and receivedDateTime lt 2024-04-30T18:30:00Z and categories/any(c:c eq 'Bills') and hasAttachments eq true",
+	}, *filters)
+	assert.Equal(t, models.BillEmails{{
+		MessageId: "airtel-1",
+		BillName:  "airtel",
+		Year:      2024,
+		Month:     time.April,
+		Bill:      models.Bill{Filename: "airtel.pdf", Data: []byte("airtel bill")},
+	}}, emails)
+	assert.Equal(t, models.SkippedEmails{{MessageId: "act-1", BillName: "act", Reason: "email not found in mailbox"}}, skipped)
+}
+
+func TestGraphMailSourceSearchErrors(t *testing.T) {
+	server, _ := startGraphServer(t)
+	params := []struct {
+		name        string
+		billConfig  config.BillConfig
+		expectedErr string
+	}{
+		{"QueryRules", config.BillConfig{Query: []string{"filename:pdf"}}, "query rules are supported only with gmail, bill: bill"},
+		{"NoFolderCategoryOrRules", config.BillConfig{}, "no folder, category or query rules configured for bill: bill"},
+		{"FolderNotFound", config.BillConfig{Folder: "Inbox/Receipts"}, "mail folder not found: Inbox/Receipts"},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			cfg := config.Config{BillConfigs: config.BillConfigs{"bill": param.billConfig}}
+
+			_, err := services.NewGraphMailSource(server.Client(), server.URL, cfg).Search("bill", utils.MonthPeriod(2024, time.April, time.UTC))
+
+			assert.EqualError(t, err, param.expectedErr)
+		})
+	}
+}
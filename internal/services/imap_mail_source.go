@@ -0,0 +1,217 @@
+package services
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const imapDefaultFolder = "INBOX"
+
+// imapMailSource reads emails from the folders of an IMAP mailbox, using the
+// folder of a bill in place of a Gmail label. Message ids are of the form
+// <folder>/<uid>.
+type imapMailSource struct {
+	cfg    config.Config
+	client *client.Client
+	// contents holds the attachments of the last read email, as they are
+	// read along with the email.
+	contents map[string]map[string][]byte
+}
+
+func (s *imapMailSource) connect() (*client.Client, error) {
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	imapCfg := s.cfg.IMAP
+	log.WithField("address", imapCfg.Address).Info("connecting to imap server")
+	var c *client.Client
+	var err error
+	if imapCfg.Plaintext {
+		c, err = client.Dial(imapCfg.Address)
+	} else {
+		c, err = client.DialTLS(imapCfg.Address, &tls.Config{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to imap server: %v", err)
+	}
+
+	log.WithField("username", imapCfg.Username).Debug("logging in to imap server")
+	if err := c.Login(imapCfg.Username, imapCfg.Password); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("failed to login to imap server: %v", err)
+	}
+	s.client = c
+
+	return c, nil
+}
+
+// Search lists the emails in the folder of the bill matching its sender and
+// subject rules. IMAP searches by date only, so the emails are filtered by
+// their exact received time.
+func (s *imapMailSource) Search(billName string, period utils.Period) ([]string, error) {
+	billConfig, err := folderBillConfig(s.cfg, billName)
+	if err != nil {
+		return nil, err
+	}
+	folder := billConfig.Folder
+	if folder == "" {
+		folder = imapDefaultFolder
+	}
+
+	c, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Select(folder, true); err != nil {
+		return nil, fmt.Errorf("failed to select folder: %v: %v", folder, err)
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Since = period.Start.AddDate(0, 0, -1)
+	criteria.Before = period.End.AddDate(0, 0, 1)
+	if billConfig.From != "" {
+		criteria.Header.Add("From", billConfig.From)
+	}
+	if billConfig.Subject != "" {
+		criteria.Header.Add("Subject", billConfig.Subject)
+	}
+	log.WithField("billName", billName).WithField("folder", folder).Info("searching emails in imap folder")
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, err
+	}
+	if len(uids) == 0 {
+		return []string{}, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchBodyStructure}
+	messages := make(chan *imap.Message, len(uids))
+	if err := c.UidFetch(seqSet, items, messages); err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(uids))
+	for m := range messages {
+		if !period.Contains(m.InternalDate) {
+			continue
+		}
+		if billConfig.HasAttachment && !hasIMAPAttachment(m.BodyStructure) {
+			continue
+		}
+		result = append(result, fmt.Sprintf("%s/%d", folder, m.Uid))
+	}
+
+	return result, nil
+}
+
+func (s *imapMailSource) Message(id string) (models.MailMessage, error) {
+	folder, uid, err := parseIMAPMessageId(id)
+	if err != nil {
+		return models.MailMessage{}, err
+	}
+
+	c, err := s.connect()
+	if err != nil {
+		return models.MailMessage{}, err
+	}
+	if _, err := c.Select(folder, true); err != nil {
+		return models.MailMessage{}, fmt.Errorf("failed to select folder: %v: %v", folder, err)
+	}
+
+	log.WithField("messageId", id).Debug("fetching email")
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, section.FetchItem()}
+	messages := make(chan *imap.Message, 1)
+	if err := c.UidFetch(seqSet, items, messages); err != nil {
+		return models.MailMessage{}, err
+	}
+	m, ok := <-messages
+	if !ok || m == nil {
+		return models.MailMessage{}, fmt.Errorf("%w, messageId: %v", ErrMessageNotFound, id)
+	}
+	body := m.GetBody(section)
+	if body == nil {
+		return models.MailMessage{}, fmt.Errorf("%w, messageId: %v", ErrMessageNotFound, id)
+	}
+
+	message, contents, err := parseMailMessage(id, m.InternalDate, body)
+	if err != nil {
+		return models.MailMessage{}, err
+	}
+	s.contents = map[string]map[string][]byte{id: contents}
+
+	return message, nil
+}
+
+func (s *imapMailSource) Attachment(message models.MailMessage, attachment models.Attachment) ([]byte, error) {
+	if _, ok := s.contents[message.Id]; !ok {
+		if _, err := s.Message(message.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	content, ok := s.contents[message.Id][attachment.Id]
+	if !ok {
+		return nil, fmt.Errorf("attachment not found in email, messageId: %v, attachmentId: %v", message.Id, attachment.Id)
+	}
+	return content, nil
+}
+
+func (s *imapMailSource) Close() error {
+	if s.client == nil {
+		return nil
+	}
+
+	log.Debug("logging out from imap server")
+	err := s.client.Logout()
+	s.client = nil
+	return err
+}
+
+func hasIMAPAttachment(bodyStructure *imap.BodyStructure) bool {
+	if bodyStructure == nil {
+		return false
+	}
+
+	found := false
+	bodyStructure.Walk(func(path []int, part *imap.BodyStructure) bool {
+		if filename, _ := part.Filename(); filename != "" || strings.EqualFold(part.Disposition, "attachment") {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+func parseIMAPMessageId(id string) (string, uint32, error) {
+	i := strings.LastIndex(id, "/")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid imap messageId: %v", id)
+	}
+	uid, err := strconv.ParseUint(id[i+1:], 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid imap messageId: %v", id)
+	}
+
+	return id[:i], uint32(uid), nil
+}
+
+// NewIMAPMailSource creates a mail source that connects to the IMAP server on
+// first use. It is an io.Closer that should be closed after use.
+func NewIMAPMailSource(cfg config.Config) MailSource {
+	return &imapMailSource{cfg: cfg}
+}
@@ -0,0 +1,96 @@
+package services_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/arunvelsriram/sodexwoe/internal/testutils"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIMAPMailSourceGetEmails(t *testing.T) {
+	april := time.Date(2024, time.April, 10, 10, 0, 0, 0, time.UTC)
+	march := time.Date(2024, time.March, 31, 23, 0, 0, 0, time.UTC)
+	may := time.Date(2024, time.May, 2, 10, 0, 0, 0, time.UTC)
+	addr := testutils.StartIMAPServer(t, map[string]map[time.Time][]byte{
+		"INBOX": {
+			april:                 testutils.Email(april, "ebill@actcorp.in", "Your ACT bill", "act.pdf", []byte("act bill")),
+			april.Add(time.Hour):  testutils.Email(april.Add(time.Hour), "offers@actcorp.in", "Offers", "", nil),
+			march:                 testutils.Email(march, "ebill@actcorp.in", "Your ACT bill", "act-march.pdf", []byte("act march bill")),
+			april.Add(-time.Hour): testutils.Email(april.Add(-time.Hour), "ebill@actcorp.in", "Reminder", "", nil),
+		},
+		"Bills/Airtel": {
+			may: testutils.Email(may, "ebill@airtel.com", "Airtel bill", "airtel.pdf", []byte("airtel bill")),
+		},
+	})
+	cfg := config.Config{
+		IMAP: config.IMAPConfig{Address: addr, Username: "username", Password: "password", Plaintext: true},
+		BillConfigs: config.BillConfigs{
+			"airtel": {Folder: "Bills/Airtel", PeriodOffset: -1},
+			"act":    {From: "ebill@actcorp.in"},
+		},
+	}
+
+	mailSrc := services.NewIMAPMailSource(cfg)
+	defer mailSrc.(io.Closer).Close()
+	billEmailSrv := services.NewBillEmailService(mailSrc, cfg)
+	emails, skipped, err := billEmailSrv.GetEmails([]string{"airtel", "act"}, utils.MonthPeriod(2024, time.April, time.UTC), false)
+
+	require.NoError(t, err)
+	require.Len(t, emails, 2)
+	assert.Equal(t, "airtel", emails[0].BillName)
+	assert.Equal(t, time.April, emails[0].Month)
+	assert.Equal(t, models.Bill{Filename: "airtel.pdf", Data: []byte("airtel bill")}, emails[0].Bill)
+	assert.Equal(t, "act", emails[1].BillName)
+	assert.Equal(t, time.April, emails[1].Month)
+	assert.Equal(t, models.Bill{Filename: "act.pdf", Data: []byte("act bill")}, emails[1].Bill)
+	require.Len(t, skipped, 1)
+	assert.Equal(t, "act", skipped[0].BillName)
+	assert.Equal(t, "no attachment found in email", skipped[0].Reason)
+	assert.True(t, strings.HasPrefix(skipped[0].MessageId, "INBOX/"))
+}
+
+func TestIMAPMailSourceStrict(t *testing.T) {
+	april := time.Date(2024, time.April, 10, 10, 0, 0, 0, time.UTC)
+	addr := testutils.StartIMAPServer(t, map[string]map[time.Time][]byte{
+		"INBOX": {april: testutils.Email(april, "ebill@actcorp.in", "Reminder", "", nil)},
+	})
+	cfg := config.Config{
+		IMAP:        config.IMAPConfig{Address: addr, Username: "username", Password: "password", Plaintext: true},
+		BillConfigs: config.BillConfigs{"act": {From: "ebill@actcorp.in"}},
+	}
+
+	mailSrc := services.NewIMAPMailSource(cfg)
+	defer mailSrc.(io.Closer).Close()
+	_, _, err := services.NewBillEmailService(mailSrc, cfg).GetEmails([]string{"act"}, utils.MonthPeriod(2024, time.April, time.UTC), true)
+
+	assert.ErrorContains(t, err, "no attachment found in email")
+}
+
+func TestIMAPMailSourceSearchErrors(t *testing.T) {
+	params := []struct {
+		name        string
+		billConfig  config.BillConfig
+		expectedErr string
+	}{
+		{"QueryRules", config.BillConfig{Query: []string{"filename:pdf"}}, "query rules are supported only with gmail, bill: bill"},
+		{"NoFolderOrRules", config.BillConfig{}, "no folder or query rules configured for bill: bill"},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			cfg := config.Config{BillConfigs: config.BillConfigs{"bill": param.billConfig}}
+
+			_, err := services.NewIMAPMailSource(cfg).Search("bill", utils.MonthPeriod(2024, time.April, time.UTC))
+
+			assert.EqualError(t, err, param.expectedErr)
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	emlExtension        = ".eml"
+	localMaxHeaderSize  = 64 * 1024
+	maildirInbox        = "INBOX"
+	mboxGmailLabels     = "X-Gmail-Labels"
+	mboxSeparatorPrefix = "From "
+)
+
+// localEmail is an email of a local mail export indexed by its headers. The
+// email is read in full only when needed.
+type localEmail struct {
+	id       string
+	folders  []string
+	from     string
+	subject  string
+	received time.Time
+	read     func() ([]byte, error)
+}
+
+// localMailSource reads emails from a local mail export: a directory of .eml
+// files, mbox files or a Maildir. The folder of a bill is the directory of the
+// .eml files, the Maildir folder or, for mbox, the name of the mbox file or a
+// Gmail label of a Google Takeout export.
+type localMailSource struct {
+	cfg    config.Config
+	format string
+	path   string
+	ids    []string
+	emails map[string]localEmail
+	// contents holds the attachments of the last read email.
+	contents map[string]map[string][]byte
+}
+
+func (s *localMailSource) index() error {
+	if s.emails != nil {
+		return nil
+	}
+
+	log.WithField("format", s.format).WithField("path", s.path).Info("indexing local emails")
+	s.emails = make(map[string]localEmail)
+	var err error
+	switch s.format {
+	case constants.SOURCE_EML:
+		err = s.indexEML()
+	case constants.SOURCE_MBOX:
+		err = s.indexMbox()
+	case constants.SOURCE_MAILDIR:
+		err = s.indexMaildir()
+	default:
+		err = fmt.Errorf("unknown local mail format: %v", s.format)
+	}
+	if err != nil {
+		s.ids, s.emails = nil, nil
+		return err
+	}
+	log.Debugf("indexed local emails: %d", len(s.ids))
+
+	return nil
+}
+
+func (s *localMailSource) indexEML() error {
+	return filepath.WalkDir(s.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), emlExtension) {
+			return nil
+		}
+
+		id, err := filepath.Rel(s.path, path)
+		if err != nil {
+			return err
+		}
+		folder := filepath.ToSlash(filepath.Dir(id))
+		if folder == "." {
+			folder = ""
+		}
+		return s.addFile(filepath.ToSlash(id), []string{folder}, path)
+	})
+}
+
+// indexMaildir indexes the emails of the Maildir folders, both Maildir++
+// folders like .Bills.Airtel and nested ones like Bills/Airtel. The top level
+// folder is INBOX.
+func (s *localMailSource) indexMaildir() error {
+	return filepath.WalkDir(s.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		if name := filepath.Base(dir); name != "cur" && name != "new" {
+			return nil
+		}
+
+		folderDir, err := filepath.Rel(s.path, filepath.Dir(dir))
+		if err != nil {
+			return err
+		}
+		folder := maildirInbox
+		if folderDir != "." {
+			folder = filepath.ToSlash(folderDir)
+			if strings.HasPrefix(folder, ".") {
+				folder = strings.ReplaceAll(strings.TrimPrefix(folder, "."), ".", "/")
+			}
+		}
+		id, err := filepath.Rel(s.path, path)
+		if err != nil {
+			return err
+		}
+		return s.addFile(filepath.ToSlash(id), []string{folder}, path)
+	})
+}
+
+// indexMbox indexes the emails of the mbox file, or of every file in the mbox
+// directory.
+func (s *localMailSource) indexMbox() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return s.indexMboxFile(filepath.Base(s.path), s.path)
+	}
+
+	return filepath.WalkDir(s.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(s.path, path)
+		if err != nil {
+			return err
+		}
+		return s.indexMboxFile(filepath.ToSlash(name), path)
+	})
+}
+
+func (s *localMailSource) indexMboxFile(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	folder := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	var header bytes.Buffer
+	var start, offset int64 = -1, 0
+	inHeader, blank := false, true
+	flush := func(end int64) error {
+		if start < 0 {
+			return nil
+		}
+		id := fmt.Sprintf("%s:%d", name, start)
+		start, length := start, end-start
+		read := func() ([]byte, error) {
+			return readMboxEmail(path, start, length)
+		}
+		return s.add(id, []string{folder}, bufio.NewReader(bytes.NewReader(header.Bytes())), read, time.Time{})
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if blank && bytes.HasPrefix(line, []byte(mboxSeparatorPrefix)) {
+				if err := flush(offset); err != nil {
+					return err
+				}
+				start = offset + int64(len(line))
+				header.Reset()
+				inHeader = true
+			} else if inHeader {
+				header.Write(line)
+				inHeader = len(bytes.TrimRight(line, "\r\n")) > 0
+			}
+			blank = len(bytes.TrimRight(line, "\r\n")) == 0
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return flush(offset)
+}
+
+// readMboxEmail reads an email from the mbox file, unescaping the lines
+// starting with From that were quoted with '>'.
+func readMboxEmail(path string, start, length int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, start); err != nil {
+		return nil, err
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for i, line := range lines {
+		if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte(mboxSeparatorPrefix)) {
+			lines[i] = line[1:]
+		}
+	}
+	return bytes.Join(lines, nil), nil
+}
+
+func (s *localMailSource) addFile(id string, folders []string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := bufio.NewReader(io.LimitReader(f, localMaxHeaderSize))
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	read := func() ([]byte, error) {
+		return os.ReadFile(path)
+	}
+	return s.add(id, folders, header, read, info.ModTime())
+}
+
+// add indexes an email using its header. The date of the email is used as the
+// received time, falling back to modTime when it has no valid date.
+func (s *localMailSource) add(id string, folders []string, header *bufio.Reader, read func() ([]byte, error), modTime time.Time) error {
+	h, err := textproto.ReadHeader(header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		log.WithField("messageId", id).Warnf("skipping email with invalid header: %v", err)
+		return nil
+	}
+	mailHeader := mail.Header{Header: message.Header{Header: h}}
+
+	email := localEmail{id: id, folders: folders, read: read}
+	if addresses, err := mailHeader.AddressList("From"); err == nil {
+		for _, address := range addresses {
+			email.from += strings.ToLower(address.Name + " " + address.Address + " ")
+		}
+	} else {
+		email.from = strings.ToLower(mailHeader.Get("From"))
+	}
+	if subject, err := mailHeader.Subject(); err == nil {
+		email.subject = strings.ToLower(subject)
+	}
+	if labels := mailHeader.Get(mboxGmailLabels); labels != "" {
+		for _, label := range strings.Split(labels, ",") {
+			email.folders = append(email.folders, strings.TrimSpace(label))
+		}
+	}
+	if email.received, err = mailHeader.Date(); err != nil || email.received.IsZero() {
+		if modTime.IsZero() {
+			log.WithField("messageId", id).Warn("skipping email without a date")
+			return nil
+		}
+		email.received = modTime
+	}
+
+	s.ids = append(s.ids, id)
+	s.emails[id] = email
+	return nil
+}
+
+// Search lists the emails in the folder of the bill matching its sender and
+// subject rules. Without a folder, emails in all folders are searched.
+func (s *localMailSource) Search(billName string, period utils.Period) ([]string, error) {
+	billConfig, err := folderBillConfig(s.cfg, billName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.index(); err != nil {
+		return nil, err
+	}
+
+	log.WithField("billName", billName).WithField("folder", billConfig.Folder).Info("searching local emails")
+	result := make([]string, 0)
+	for _, id := range s.ids {
+		email := s.emails[id]
+		if !period.Contains(email.received) {
+			continue
+		}
+		if billConfig.Folder != "" && !hasFolder(email.folders, billConfig.Folder) {
+			continue
+		}
+		if billConfig.From != "" && !strings.Contains(email.from, strings.ToLower(billConfig.From)) {
+			continue
+		}
+		if billConfig.Subject != "" && !strings.Contains(email.subject, strings.ToLower(billConfig.Subject)) {
+			continue
+		}
+		if billConfig.HasAttachment {
+			message, err := s.Message(id)
+			if err != nil {
+				return nil, err
+			}
+			if len(message.Attachments) == 0 {
+				continue
+			}
+		}
+		result = append(result, id)
+	}
+
+	return result, nil
+}
+
+func (s *localMailSource) Message(id string) (models.MailMessage, error) {
+	if err := s.index(); err != nil {
+		return models.MailMessage{}, err
+	}
+	email, ok := s.emails[id]
+	if !ok {
+		return models.MailMessage{}, fmt.Errorf("%w, messageId: %v", ErrMessageNotFound, id)
+	}
+
+	log.WithField("messageId", id).Debug("reading email")
+	data, err := email.read()
+	if err != nil {
+		return models.MailMessage{}, fmt.Errorf("unable to read email, messageId: %v: %v", id, err)
+	}
+	message, contents, err := parseMailMessage(id, email.received, bytes.NewReader(data))
+	if err != nil {
+		return models.MailMessage{}, err
+	}
+	s.contents = map[string]map[string][]byte{id: contents}
+
+	return message, nil
+}
+
+func (s *localMailSource) Attachment(message models.MailMessage, attachment models.Attachment) ([]byte, error) {
+	if _, ok := s.contents[message.Id]; !ok {
+		if _, err := s.Message(message.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	content, ok := s.contents[message.Id][attachment.Id]
+	if !ok {
+		return nil, fmt.Errorf("attachment not found in email, messageId: %v, attachmentId: %v", message.Id, attachment.Id)
+	}
+	return content, nil
+}
+
+func hasFolder(folders []string, folder string) bool {
+	for _, f := range folders {
+		if strings.EqualFold(f, folder) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewLocalMailSource creates a mail source that reads emails from the local
+// mail export at path, in the eml, mbox or maildir format. The export is
+// indexed on first use.
+func NewLocalMailSource(format, path string, cfg config.Config) MailSource {
+	return &localMailSource{cfg: cfg, format: format, path: path}
+}
@@ -0,0 +1,122 @@
+package services_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/arunvelsriram/sodexwoe/internal/testutils"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string][]byte) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, content, 0644))
+	}
+}
+
+// testMbox builds a Google Takeout like mbox of the emails, each with the
+// given Gmail labels.
+func testMbox(emails map[string][]byte) []byte {
+	var b bytes.Buffer
+	for labels, email := range emails {
+		b.WriteString("From 1234567890@xxx Mon Apr 01 10:00:00 +0000 2024\r\n")
+		b.WriteString("X-Gmail-Labels: " + labels + "\r\n")
+		b.Write(bytes.ReplaceAll(email, []byte("\r\nFrom "), []byte("\r\n>From ")))
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
+
+func TestLocalMailSourceGetEmails(t *testing.T) {
+	april := time.Date(2024, time.April, 10, 10, 0, 0, 0, time.UTC)
+	march := time.Date(2024, time.March, 31, 23, 0, 0, 0, time.UTC)
+	may := time.Date(2024, time.May, 2, 10, 0, 0, 0, time.UTC)
+	airtel := testutils.Email(may, "Airtel <ebill@airtel.com>", "Airtel bill", "airtel.pdf", []byte("airtel bill"))
+	act := testutils.Email(april, "ebill@actcorp.in", "Your ACT bill", "act.pdf", []byte("act bill"))
+	actMarch := testutils.Email(march, "ebill@actcorp.in", "Your ACT bill", "act-march.pdf", []byte("act march bill"))
+	actReminder := testutils.Email(april, "ebill@actcorp.in", "Reminder", "", nil)
+	offers := testutils.Email(april, "offers@actcorp.in", "Offers", "offers.pdf", []byte("offers"))
+
+	params := []struct {
+		format string
+		files  map[string][]byte
+	}{
+		{constants.SOURCE_EML, map[string][]byte{
+			"Bills/Airtel/airtel.eml": airtel,
+			"act.eml":                 act,
+			"act-march.eml":           actMarch,
+			"act-reminder.eml":        actReminder,
+			"offers.eml":              offers,
+			"notes.txt":               []byte("not an email"),
+		}},
+		{constants.SOURCE_MAILDIR, map[string][]byte{
+			".Bills.Airtel/cur/1.host:2,S": airtel,
+			"cur/2.host:2,S":               act,
+			"cur/3.host:2,S":               actMarch,
+			"new/4.host":                   actReminder,
+			"new/5.host":                   offers,
+			"tmp/6.host":                   act,
+		}},
+		{constants.SOURCE_MBOX, map[string][]byte{
+			"All mail.mbox": testMbox(map[string][]byte{
+				"Bills/Airtel,Opened": airtel,
+				"Inbox":               act,
+				"Inbox,Opened":        actMarch,
+				"Inbox,Unread":        actReminder,
+				"Category Promotions": offers,
+			}),
+		}},
+	}
+
+	for _, param := range params {
+		t.Run(param.format, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFiles(t, dir, param.files)
+			cfg := config.Config{
+				BillConfigs: config.BillConfigs{
+					"airtel": {Folder: "Bills/Airtel", PeriodOffset: -1},
+					"act":    {From: "ebill@actcorp.in", Subject: "act"},
+				},
+			}
+
+			mailSrc := services.NewLocalMailSource(param.format, dir, cfg)
+			emails, skipped, err := services.NewBillEmailService(mailSrc, cfg).GetEmails([]string{"airtel", "act"}, utils.MonthPeriod(2024, time.April, time.UTC), false)
+
+			require.NoError(t, err)
+			require.Len(t, emails, 2)
+			assert.Equal(t, "airtel", emails[0].BillName)
+			assert.Equal(t, time.April, emails[0].Month)
+			assert.Equal(t, models.Bill{Filename: "airtel.pdf", Data: []byte("airtel bill")}, emails[0].Bill)
+			assert.Equal(t, "act", emails[1].BillName)
+			assert.Equal(t, time.April, emails[1].Month)
+			assert.Equal(t, models.Bill{Filename: "act.pdf", Data: []byte("act bill")}, emails[1].Bill)
+			assert.Empty(t, skipped)
+		})
+	}
+}
+
+func TestLocalMailSourceHasAttachment(t *testing.T) {
+	april := time.Date(2024, time.April, 10, 10, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string][]byte{
+		"act.eml":          testutils.Email(april, "ebill@actcorp.in", "Your ACT bill", "act.pdf", []byte("act bill")),
+		"act-reminder.eml": testutils.Email(april, "ebill@actcorp.in", "Reminder", "", nil),
+	})
+	cfg := config.Config{BillConfigs: config.BillConfigs{"act": {From: "ebill@actcorp.in", HasAttachment: true}}}
+
+	messageIds, err := services.NewLocalMailSource(constants.SOURCE_EML, dir, cfg).Search("act", utils.MonthPeriod(2024, time.April, time.UTC))
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"act.eml"}, messageIds)
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+)
+
+// MailSource searches and reads bill emails from a mailbox.
+type MailSource interface {
+	// Search returns the ids of the emails of the bill received within the
+	// period.
+	Search(billName string, period utils.Period) ([]string, error)
+	Message(id string) (models.MailMessage, error)
+	Attachment(message models.MailMessage, attachment models.Attachment) ([]byte, error)
+}
+
+// HistoryMailSource is a MailSource that can list the emails that got a bill
+// since a point in the mailbox history.
+type HistoryMailSource interface {
+	MailSource
+	HistoryId() (uint64, error)
+	// NewMessages returns the ids of the emails that got each bill since its
+	// start history id, by bill name, along with the history id to continue
+	// all of them from next time.
+	NewMessages(startHistoryIds map[string]uint64) (map[string][]string, uint64, error)
+}
+
+// ProcessedMarker is a MailSource that can mark emails as processed.
+type ProcessedMarker interface {
+	MailSource
+	MarkProcessed(messageIds []string) error
+}
+
+// ErrHistoryExpired is returned when the mailbox no longer has the history
+// records since the requested history id.
+var ErrHistoryExpired = errors.New("mailbox history id has expired")
+
+// ErrMessageNotFound is returned when an email is no longer in the mailbox.
+var ErrMessageNotFound = errors.New("email not found in mailbox")
+
+// folderBillConfig returns the config of a bill for mail sources that find
+// bills by folder and sender/subject rules instead of Gmail labels and queries.
+func folderBillConfig(cfg config.Config, billName string) (config.BillConfig, error) {
+	billConfig, err := cfg.Bill(billName)
+	if err != nil {
+		return config.BillConfig{}, err
+	}
+	if len(billConfig.Query) > 0 {
+		return config.BillConfig{}, fmt.Errorf("query rules are supported only with gmail, bill: %v", billName)
+	}
+	if billConfig.Folder == "" && !billConfig.HasRules() {
+		return config.BillConfig{}, fmt.Errorf("no folder or query rules configured for bill: %v", billName)
+	}
+
+	return billConfig, nil
+}
+
+// parseMailMessage parses a RFC 5322 email, returning it along with the
+// content of its attachments by attachment id. The date of the email is used
+// when received is zero.
+func parseMailMessage(id string, received time.Time, r io.Reader) (models.MailMessage, map[string][]byte, error) {
+	mr, err := mail.CreateReader(r)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return models.MailMessage{}, nil, fmt.Errorf("unable to parse email, messageId: %v: %v", id, err)
+	}
+	defer mr.Close()
+
+	result := models.MailMessage{Id: id, Received: received}
+	if from, err := mr.Header.AddressList("From"); err == nil && len(from) > 0 {
+		result.From = from[0].Address
+	}
+	if subject, err := mr.Header.Subject(); err == nil {
+		result.Subject = subject
+	}
+	if result.Received.IsZero() {
+		if result.Received, err = mr.Header.Date(); err != nil {
+			return models.MailMessage{}, nil, fmt.Errorf("unable to parse date of email, messageId: %v: %v", id, err)
+		}
+	}
+
+	contents := make(map[string][]byte)
+	for index := 1; ; index++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !message.IsUnknownCharset(err) {
+			return models.MailMessage{}, nil, fmt.Errorf("unable to parse email, messageId: %v: %v", id, err)
+		}
+
+		var filename string
+		switch h := part.Header.(type) {
+		case *mail.AttachmentHeader:
+			filename, _ = h.Filename()
+		case *mail.InlineHeader:
+			if _, params, err := h.ContentDisposition(); err == nil {
+				filename = params["filename"]
+			}
+			if _, params, err := h.ContentType(); err == nil && filename == "" {
+				filename = params["name"]
+			}
+		}
+		if filename == "" {
+			continue
+		}
+
+		content, err := io.ReadAll(part.Body)
+		if err != nil {
+			return models.MailMessage{}, nil, err
+		}
+		attachmentId := strconv.Itoa(index)
+		result.Attachments = append(result.Attachments, models.Attachment{Id: attachmentId, Filename: filename})
+		contents[attachmentId] = content
+	}
+
+	return result, contents, nil
+}
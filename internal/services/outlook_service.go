@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/oauth2"
+)
+
+const (
+	microsoftLoginURL     = "https://login.microsoftonline.com/"
+	microsoftTenantCommon = "common"
+	graphMailReadScope    = "Mail.Read"
+	offlineAccessScope    = "offline_access"
+)
+
+// NewOutlookClient creates an HTTP client authorized to read emails using the
+// Microsoft Graph API, saving its token in the token store. The user signs in
+// using a device code the first time.
+func NewOutlookClient(outlookCfg config.OutlookConfig, tokenStore TokenStore) (*http.Client, error) {
+	return newOutlookClient(outlookCfg, tokenStore, microsoftLoginURL, os.Stdout)
+}
+
+// newOutlookClient creates the client signing in using the Microsoft identity
+// platform at the login URL, writing the device code prompt to out.
+func newOutlookClient(outlookCfg config.OutlookConfig, tokenStore TokenStore, loginURL string, out io.Writer) (*http.Client, error) {
+	if outlookCfg.ClientId == "" {
+		return nil, errors.New("outlook client_id is not configured")
+	}
+	tenant := outlookCfg.Tenant
+	if tenant == "" {
+		tenant = microsoftTenantCommon
+	}
+	authorityURL := loginURL + tenant + "/oauth2/v2.0/"
+	oauthCfg := &oauth2.Config{
+		ClientID: outlookCfg.ClientId,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   authorityURL + "authorize",
+			TokenURL:  authorityURL + "token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+		Scopes: []string{graphMailReadScope, offlineAccessScope},
+	}
+
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		log.Debug("unable to identify the home directory")
+		return nil, err
+	}
+	tokFile := filepath.Join(homeDir, constants.OUTLOOK_TOKEN_FILE)
+
+	return newTokenClient(oauthCfg, tokenStore, tokFile, nil, func() (*oauth2.Token, error) {
+		log.Info("signing in using a device code")
+		return getTokenFromDevice(context.Background(), http.DefaultClient, oauthCfg, authorityURL+"devicecode", out)
+	})
+}
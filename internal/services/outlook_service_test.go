@@ -0,0 +1,67 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewOutlookClient(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+	pollQuickly(t)
+	deviceRequests := make([]url.Values, 0)
+	tokenRequests := make([]url.Values, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/organizations/oauth2/v2.0/devicecode", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		deviceRequests = append(deviceRequests, r.PostForm)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"device_code":"device-code","user_code":"ABCD-EFGH","verification_uri":"https://microsoft.com/devicelogin","expires_in":900}`))
+	})
+	mux.HandleFunc("/organizations/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		tokenRequests = append(tokenRequests, r.PostForm)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testTokenResponse))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	outlookCfg := config.OutlookConfig{ClientId: "sodexwoe", Tenant: "organizations"}
+	var out bytes.Buffer
+
+	client, err := newOutlookClient(outlookCfg, fileTokenStore{}, server.URL+"/", &out)
+	require.NoError(t, err)
+	assert.NotNil(t, client)
+	_, err = newOutlookClient(outlookCfg, fileTokenStore{}, server.URL+"/", io.Discard)
+	require.NoError(t, err)
+
+	assert.Equal(t, "To sign in, open https://microsoft.com/devicelogin and enter the code: ABCD-EFGH\n", out.String())
+	require.Len(t, deviceRequests, 1)
+	assert.Equal(t, "sodexwoe", deviceRequests[0].Get("client_id"))
+	assert.Equal(t, "Mail.Read offline_access", deviceRequests[0].Get("scope"))
+	require.Len(t, tokenRequests, 1)
+	assert.Equal(t, "device-code", tokenRequests[0].Get("device_code"))
+	saved, err := loadToken(fileTokenStore{}, filepath.Join(home, constants.OUTLOOK_TOKEN_FILE))
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", saved.AccessToken)
+	assert.Equal(t, "refresh-token", saved.RefreshToken)
+}
+
+func TestNewOutlookClientWithoutClientId(t *testing.T) {
+	_, err := newOutlookClient(config.OutlookConfig{}, fileTokenStore{}, "http://127.0.0.1/", io.Discard)
+
+	assert.EqualError(t, err, "outlook client_id is not configured")
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// errServiceAccountSignIn is returned when signing in is attempted using a
+// service account key, which reads the mailbox of the user it impersonates
+// without signing in.
+var errServiceAccountSignIn = errors.New("signing in is not needed when using a service account key")
+
+// isServiceAccountKey reports whether the credentials are the JSON key of a
+// service account, instead of the client_secret.json of an OAuth client.
+func isServiceAccountKey(credentials []byte) bool {
+	var key struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(credentials, &key); err != nil {
+		return false
+	}
+	return key.Type == "service_account"
+}
+
+// serviceAccountClient returns a client impersonating the email of the account
+// using the service account key, which needs domain-wide delegation of the
+// scopes in the Google Workspace domain of the account.
+func serviceAccountClient(key []byte, account GoogleAccount, scopes ...string) (*http.Client, error) {
+	if account.Email == "" {
+		return nil, errors.New("email of the Google account to impersonate using the service account key is not configured")
+	}
+	config, err := google.JWTConfigFromJSON(key, scopes...)
+	if err != nil {
+		log.Debug("failed get service account config from JSON")
+		return nil, fmt.Errorf("invalid service account key: %v", err)
+	}
+	config.Subject = account.Email
+
+	log.WithField("email", account.Email).WithField("serviceAccount", config.Email).Info("impersonating google account")
+	ctx := context.Background()
+	ts := oauth2.ReuseTokenSource(nil, config.TokenSource(ctx))
+	if _, err := ts.Token(); err != nil {
+		return nil, fmt.Errorf("unable to impersonate %v using the service account, check its domain-wide delegation for the scopes: %v", account.Email, err)
+	}
+
+	return oauth2.NewClient(ctx, ts), nil
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+)
+
+// serviceAccountKey creates a service account key using the token endpoint.
+func serviceAccountKey(t *testing.T, tokenURL string) []byte {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	key, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "sodexwoe@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    tokenURL,
+	})
+	require.NoError(t, err)
+	return key
+}
+
+func TestIsServiceAccountKey(t *testing.T) {
+	params := []struct {
+		name        string
+		credentials string
+		expected    bool
+	}{
+		{"ServiceAccountKey", `{"type":"service_account","client_email":"sodexwoe@project.iam.gserviceaccount.com"}`, true},
+		{"InstalledClient", `{"installed":{"client_id":"sodexwoe"}}`, false},
+		{"WebClient", `{"web":{"client_id":"sodexwoe"}}`, false},
+		{"OtherType", `{"type":"authorized_user"}`, false},
+		{"InvalidJSON", `{"type":"service_account"`, false},
+		{"Empty", ``, false},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			assert.Equal(t, param.expected, isServiceAccountKey([]byte(param.credentials)))
+		})
+	}
+}
+
+func TestServiceAccountClient(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"impersonated","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	client, err := serviceAccountClient(serviceAccountKey(t, server.URL), GoogleAccount{Email: "me@example.com"}, gmail.GmailReadonlyScope)
+
+	require.NoError(t, err)
+	assert.NotNil(t, client)
+	assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", form.Get("grant_type"))
+	parts := strings.Split(form.Get("assertion"), ".")
+	require.Len(t, parts, 3)
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	var claims struct {
+		Issuer  string `json:"iss"`
+		Subject string `json:"sub"`
+		Scope   string `json:"scope"`
+	}
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, "sodexwoe@project.iam.gserviceaccount.com", claims.Issuer)
+	assert.Equal(t, "me@example.com", claims.Subject)
+	assert.Equal(t, gmail.GmailReadonlyScope, claims.Scope)
+}
+
+func TestServiceAccountClientErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"unauthorized_client","error_description":"Client is unauthorized to retrieve access tokens using this method."}`))
+	}))
+	defer server.Close()
+	params := []struct {
+		name    string
+		key     []byte
+		account GoogleAccount
+		err     string
+	}{
+		{"NoEmail", serviceAccountKey(t, server.URL), GoogleAccount{Name: "office"}, "email of the Google account to impersonate using the service account key is not configured"},
+		{"InvalidKey", []byte(`{"type":"service_account"`), GoogleAccount{Email: "me@example.com"}, "invalid service account key: "},
+		{"NotDelegated", serviceAccountKey(t, server.URL), GoogleAccount{Email: "me@example.com"}, "unable to impersonate me@example.com using the service account, check its domain-wide delegation for the scopes: "},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			_, err := serviceAccountClient(param.key, param.account, gmail.GmailReadonlyScope)
+
+			require.Error(t, err)
+			assert.True(t, strings.HasPrefix(err.Error(), param.err), err.Error())
+		})
+	}
+}
+
+func TestNewGmailServiceServiceAccountKeyWithoutEmail(t *testing.T) {
+	_, err := NewGmailService(serviceAccountKey(t, "http://127.0.0.1"), fileTokenStore{}, GoogleAccount{}, false, gmail.GmailReadonlyScope)
+
+	assert.EqualError(t, err, "email of the Google account to impersonate using the service account key is not configured")
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/arunvelsriram/sodexwoe/internal/models"
+	log "github.com/sirupsen/logrus"
+)
+
+type SyncStateService interface {
+	Load() (models.SyncState, bool, error)
+	Save(state models.SyncState) error
+}
+
+type syncStateService struct {
+	path string
+}
+
+func (s syncStateService) Load() (models.SyncState, bool, error) {
+	state := models.SyncState{HistoryIds: make(map[string]uint64)}
+	content, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.WithField("path", s.path).Debug("sync state not found")
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, err
+	}
+
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, false, err
+	}
+	if state.HistoryIds == nil {
+		state.HistoryIds = make(map[string]uint64)
+	}
+	return state, true, nil
+}
+
+func (s syncStateService) Save(state models.SyncState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("path", s.path).Info("saving sync state")
+	return writeFileAtomic(s.path, content)
+}
+
+func NewSyncStateService(path string) SyncStateService {
+	return syncStateService{path}
+}
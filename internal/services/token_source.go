@@ -0,0 +1,216 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// impliedScopes are the scopes that include a scope.
+var impliedScopes = map[string][]string{
+	gmail.GmailReadonlyScope: {gmail.GmailModifyScope, gmail.MailGoogleComScope},
+	gmail.GmailModifyScope:   {gmail.MailGoogleComScope},
+}
+
+// storedToken is a token saved in a token file, along with the scopes granted
+// to it when known.
+type storedToken struct {
+	oauth2.Token
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// authorizeFunc signs in the user to get a new token.
+type authorizeFunc func() (*oauth2.Token, error)
+
+// persistingTokenSource is a token source that saves refreshed tokens in the
+// token store. The user signs in again when the refresh token is revoked or
+// expired.
+type persistingTokenSource struct {
+	config    *oauth2.Config
+	store     TokenStore
+	path      string
+	authorize authorizeFunc
+
+	mu     sync.Mutex
+	src    oauth2.TokenSource
+	saved  *oauth2.Token
+	scopes []string
+}
+
+// newTokenClient creates an HTTP client using the token saved in the store by
+// the token file. The user signs in using authorize when there is no saved
+// token, or it was not granted the required scopes, which are not checked
+// when nil. A saved token that cannot be read is an error.
+func newTokenClient(config *oauth2.Config, store TokenStore, tokFile string, requiredScopes []string, authorize authorizeFunc) (*http.Client, error) {
+	s := &persistingTokenSource{config: config, store: store, path: tokFile, authorize: authorize}
+
+	log.WithField("tokenFile", tokFile).Debug("trying to use token from file")
+	stored, err := loadToken(store, tokFile)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		log.WithField("tokenFile", tokFile).Info("token file not found so signing in")
+		err = s.reauthorize()
+	case err != nil:
+		return nil, err
+	case requiredScopes != nil && !hasScopes(stored.Scopes, requiredScopes):
+		log.WithField("tokenFile", tokFile).
+			WithField("scopes", strings.Join(stored.Scopes, " ")).
+			WithField("requiredScopes", strings.Join(requiredScopes, " ")).
+			Info("token was not granted the required scopes so signing in again")
+		err = s.reauthorize()
+	default:
+		log.WithField("tokenFile", tokFile).Info("used token from file")
+		s.use(&stored.Token, stored.Scopes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Refreshing an expired token early signs in again right away when the
+	// refresh token is no longer valid.
+	if _, err := s.Token(); err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(context.Background(), s), nil
+}
+
+// Token returns a valid token, saving it when it was refreshed.
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tok, err := s.src.Token()
+	if isInvalidGrant(err) {
+		log.WithField("tokenFile", s.path).WithField("reason", err).Warn("token was revoked or has expired so signing in again")
+		if err := s.reauthorize(); err != nil {
+			return nil, err
+		}
+		tok, err = s.src.Token()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.AccessToken != s.saved.AccessToken {
+		log.WithField("tokenFile", s.path).Debug("token was refreshed")
+		if scopes := grantedScopes(tok); scopes != nil {
+			s.scopes = scopes
+		}
+		if err := saveToken(s.store, s.path, tok, s.scopes); err != nil {
+			log.WithField("tokenFile", s.path).Errorf("failed to save the refreshed token: %v", err)
+		}
+		s.saved = tok
+	}
+	return tok, nil
+}
+
+// reauthorize signs in the user and saves the new token.
+func (s *persistingTokenSource) reauthorize() error {
+	tok, err := s.authorize()
+	if err != nil {
+		log.Debug("failed to sign in")
+		return err
+	}
+
+	scopes := grantedScopes(tok)
+	if scopes == nil {
+		scopes = s.config.Scopes
+	}
+	log.WithField("tokenFile", s.path).Info("saving token in file")
+	if err := saveToken(s.store, s.path, tok, scopes); err != nil {
+		log.Debug("failed to save the token")
+		return err
+	}
+	s.use(tok, scopes)
+	return nil
+}
+
+func (s *persistingTokenSource) use(tok *oauth2.Token, scopes []string) {
+	s.src = s.config.TokenSource(context.Background(), tok)
+	s.saved = tok
+	s.scopes = scopes
+}
+
+// grantedScopes returns the scopes in the token response, which is nil when
+// the response did not have them.
+func grantedScopes(tok *oauth2.Token) []string {
+	scope, ok := tok.Extra("scope").(string)
+	if !ok || scope == "" {
+		return nil
+	}
+	return strings.Fields(scope)
+}
+
+// hasScopes reports whether the granted scopes include the required scopes.
+// Tokens saved without their scopes by earlier versions are assumed to have
+// only the read only scope.
+func hasScopes(granted, required []string) bool {
+	if granted == nil {
+		granted = []string{gmail.GmailReadonlyScope}
+	}
+	grantedSet := make(map[string]bool, len(granted))
+	for _, scope := range granted {
+		grantedSet[scope] = true
+	}
+	for _, scope := range required {
+		if grantedSet[scope] {
+			continue
+		}
+		implied := false
+		for _, impliedBy := range impliedScopes[scope] {
+			implied = implied || grantedSet[impliedBy]
+		}
+		if !implied {
+			return false
+		}
+	}
+	return true
+}
+
+// isInvalidGrant reports whether the token could not be refreshed as the
+// refresh token is no longer valid.
+func isInvalidGrant(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+	var res struct {
+		Error string `json:"error"`
+	}
+	return json.Unmarshal(retrieveErr.Body, &res) == nil && res.Error == "invalid_grant"
+}
+
+// Retrieves a token saved in the store by the token file.
+func loadToken(store TokenStore, file string) (storedToken, error) {
+	var tok storedToken
+	content, err := store.Load(file)
+	if err != nil {
+		log.WithField("file", file).Debugf("failed to get token from file")
+		return tok, err
+	}
+	err = json.Unmarshal(content, &tok)
+	return tok, err
+}
+
+// Saves a token along with its scopes in the store by the token file.
+func saveToken(store TokenStore, path string, token *oauth2.Token, scopes []string) error {
+	log.WithField("path", path).WithField("location", store.Location(path)).Info("saving credential file")
+	content, err := json.Marshal(storedToken{Token: *token, Scopes: scopes})
+	if err != nil {
+		return err
+	}
+	if err := store.Save(path, content); err != nil {
+		log.Debug("unable to cache oauth token")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// tokenServer is a fake OAuth 2.0 token endpoint responding to every refresh
+// with the response.
+func tokenServer(t *testing.T, status int, response string) (*oauth2.Config, *[]url.Values) {
+	requests := make([]url.Values, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		requests = append(requests, r.PostForm)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+
+	config := &oauth2.Config{
+		ClientID: "sodexwoe",
+		Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams},
+		Scopes:   []string{gmail.GmailModifyScope},
+	}
+	return config, &requests
+}
+
+// signIn is an authorizeFunc counting the sign ins, each getting a token
+// granted the scope.
+func signIn(count *int, scope string) authorizeFunc {
+	return func() (*oauth2.Token, error) {
+		*count++
+		tok := &oauth2.Token{AccessToken: "signed-in", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}
+		return tok.WithExtra(map[string]interface{}{"scope": scope}), nil
+	}
+}
+
+func saveTestToken(t *testing.T, tok oauth2.Token, scopes []string) string {
+	path := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(t, saveToken(fileTokenStore{}, path, &tok, scopes))
+	return path
+}
+
+func TestNewTokenClientUsesSavedToken(t *testing.T) {
+	config, requests := tokenServer(t, http.StatusOK, `{}`)
+	path := saveTestToken(t, oauth2.Token{AccessToken: "saved", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}, []string{gmail.MailGoogleComScope})
+	signIns := 0
+
+	_, err := newTokenClient(config, fileTokenStore{}, path, config.Scopes, signIn(&signIns, gmail.GmailModifyScope))
+
+	require.NoError(t, err)
+	assert.Equal(t, 0, signIns)
+	assert.Empty(t, *requests)
+}
+
+func TestNewTokenClientSignsInWithoutSavedToken(t *testing.T) {
+	config, _ := tokenServer(t, http.StatusOK, `{}`)
+	path := filepath.Join(t.TempDir(), "token.json")
+	signIns := 0
+
+	_, err := newTokenClient(config, fileTokenStore{}, path, config.Scopes, signIn(&signIns, gmail.GmailModifyScope))
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, signIns)
+	assert.FileExists(t, path)
+}
+
+func TestNewTokenClientUnreadableToken(t *testing.T) {
+	config, _ := tokenServer(t, http.StatusOK, `{}`)
+	path := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+	signIns := 0
+
+	_, err := newTokenClient(config, fileTokenStore{}, path, config.Scopes, signIn(&signIns, gmail.GmailModifyScope))
+
+	assert.EqualError(t, err, "unexpected end of JSON input")
+	assert.Equal(t, 0, signIns)
+}
+
+func TestNewTokenClientScopeMismatch(t *testing.T) {
+	params := []struct {
+		name   string
+		scopes []string
+	}{
+		{"ReadonlyScope", []string{gmail.GmailReadonlyScope}},
+		{"UnknownScopes", nil},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			config, _ := tokenServer(t, http.StatusOK, `{}`)
+			path := saveTestToken(t, oauth2.Token{AccessToken: "saved", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}, param.scopes)
+			signIns := 0
+
+			_, err := newTokenClient(config, fileTokenStore{}, path, config.Scopes, signIn(&signIns, gmail.GmailModifyScope))
+
+			require.NoError(t, err)
+			assert.Equal(t, 1, signIns)
+			saved, err := loadToken(fileTokenStore{}, path)
+			require.NoError(t, err)
+			assert.Equal(t, "signed-in", saved.AccessToken)
+			assert.Equal(t, []string{gmail.GmailModifyScope}, saved.Scopes)
+		})
+	}
+}
+
+func TestNewTokenClientInvalidGrant(t *testing.T) {
+	config, requests := tokenServer(t, http.StatusBadRequest, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`)
+	path := saveTestToken(t, oauth2.Token{AccessToken: "saved", RefreshToken: "revoked", Expiry: time.Now().Add(-time.Hour)}, []string{gmail.GmailModifyScope})
+	signIns := 0
+
+	_, err := newTokenClient(config, fileTokenStore{}, path, config.Scopes, signIn(&signIns, gmail.GmailModifyScope))
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, signIns)
+	require.Len(t, *requests, 1)
+	assert.Equal(t, "revoked", (*requests)[0].Get("refresh_token"))
+	saved, err := loadToken(fileTokenStore{}, path)
+	require.NoError(t, err)
+	assert.Equal(t, "signed-in", saved.AccessToken)
+}
+
+func TestNewTokenClientRefreshError(t *testing.T) {
+	config, _ := tokenServer(t, http.StatusInternalServerError, `{"error":"internal_failure"}`)
+	path := saveTestToken(t, oauth2.Token{AccessToken: "saved", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}, []string{gmail.GmailModifyScope})
+	signIns := 0
+
+	_, err := newTokenClient(config, fileTokenStore{}, path, config.Scopes, signIn(&signIns, gmail.GmailModifyScope))
+
+	var retrieveErr *oauth2.RetrieveError
+	assert.True(t, errors.As(err, &retrieveErr))
+	assert.Equal(t, 0, signIns)
+}
+
+func TestNewTokenClientSavesRefreshedToken(t *testing.T) {
+	config, requests := tokenServer(t, http.StatusOK, `{"access_token":"refreshed","token_type":"Bearer","expires_in":3600,"scope":"`+gmail.MailGoogleComScope+`"}`)
+	path := saveTestToken(t, oauth2.Token{AccessToken: "saved", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}, []string{gmail.GmailModifyScope})
+	signIns := 0
+
+	_, err := newTokenClient(config, fileTokenStore{}, path, config.Scopes, signIn(&signIns, gmail.GmailModifyScope))
+
+	require.NoError(t, err)
+	assert.Equal(t, 0, signIns)
+	require.Len(t, *requests, 1)
+	saved, err := loadToken(fileTokenStore{}, path)
+	require.NoError(t, err)
+	assert.Equal(t, "refreshed", saved.AccessToken)
+	assert.Equal(t, "refresh", saved.RefreshToken)
+	assert.Equal(t, []string{gmail.MailGoogleComScope}, saved.Scopes)
+}
+
+func TestHasScopes(t *testing.T) {
+	params := []struct {
+		name     string
+		granted  []string
+		required []string
+		expected bool
+	}{
+		{"Granted", []string{gmail.GmailReadonlyScope}, []string{gmail.GmailReadonlyScope}, true},
+		{"Implied", []string{gmail.MailGoogleComScope}, []string{gmail.GmailReadonlyScope, gmail.GmailModifyScope}, true},
+		{"Missing", []string{gmail.GmailReadonlyScope}, []string{gmail.GmailModifyScope}, false},
+		{"UnknownReadonly", nil, []string{gmail.GmailReadonlyScope}, true},
+		{"UnknownModify", nil, []string{gmail.GmailReadonlyScope, gmail.GmailModifyScope}, false},
+		{"UnknownSettings", nil, []string{gmail.GmailSettingsBasicScope}, false},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			assert.Equal(t, param.expected, hasScopes(param.granted, param.required))
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keyringService = "sodexwoe"
+	// encryptedTokenFileExt is added to the path of a token file encrypted
+	// using a passphrase.
+	encryptedTokenFileExt = ".enc"
+	scryptN               = 1 << 15
+	scryptR               = 8
+	scryptP               = 1
+	scryptKeyLen          = 32
+	scryptSaltLen         = 16
+)
+
+// TokenStore saves the tokens of the signed in accounts, each by the path of
+// its plaintext token file. Load and Delete return fs.ErrNotExist when there
+// is no saved token.
+type TokenStore interface {
+	Load(path string) ([]byte, error)
+	Save(path string, content []byte) error
+	Delete(path string) error
+	// Location describes where the token of the path is saved.
+	Location(path string) string
+}
+
+// fileTokenStore saves the tokens as plaintext files.
+type fileTokenStore struct{}
+
+func (fileTokenStore) Load(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (fileTokenStore) Save(path string, content []byte) error {
+	return writeFileAtomic(path, content)
+}
+
+func (fileTokenStore) Delete(path string) error {
+	return os.Remove(path)
+}
+
+func (fileTokenStore) Location(path string) string {
+	return path
+}
+
+// encryptedToken is a token encrypted using AES-GCM with a key derived from a
+// passphrase using scrypt.
+type encryptedToken struct {
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// encryptedFileTokenStore saves the tokens as files encrypted using a
+// passphrase.
+type encryptedFileTokenStore struct {
+	passphrase string
+}
+
+func (s encryptedFileTokenStore) Load(path string) ([]byte, error) {
+	content, err := os.ReadFile(s.Location(path))
+	if err != nil {
+		return nil, err
+	}
+	var encrypted encryptedToken
+	if err := json.Unmarshal(content, &encrypted); err != nil {
+		return nil, fmt.Errorf("invalid encrypted token file: %v: %v", s.Location(path), err)
+	}
+
+	aead, err := s.aead(encrypted.Salt, encrypted.N, encrypted.R, encrypted.P)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted token file: %v: invalid nonce", s.Location(path))
+	}
+	plaintext, err := aead.Open(nil, encrypted.Nonce, encrypted.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt token file, check the passphrase: %v", s.Location(path))
+	}
+	return plaintext, nil
+}
+
+func (s encryptedFileTokenStore) Save(path string, content []byte) error {
+	encrypted := encryptedToken{Salt: make([]byte, scryptSaltLen), N: scryptN, R: scryptR, P: scryptP}
+	if _, err := rand.Read(encrypted.Salt); err != nil {
+		return err
+	}
+	aead, err := s.aead(encrypted.Salt, encrypted.N, encrypted.R, encrypted.P)
+	if err != nil {
+		return err
+	}
+	encrypted.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(encrypted.Nonce); err != nil {
+		return err
+	}
+	encrypted.Ciphertext = aead.Seal(nil, encrypted.Nonce, content, nil)
+
+	encryptedContent, err := json.Marshal(encrypted)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Location(path), encryptedContent)
+}
+
+func (s encryptedFileTokenStore) Delete(path string) error {
+	return os.Remove(s.Location(path))
+}
+
+func (s encryptedFileTokenStore) Location(path string) string {
+	return path + encryptedTokenFileExt
+}
+
+func (s encryptedFileTokenStore) aead(salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(s.passphrase), salt, n, r, p, scryptKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive key from passphrase: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyringTokenStore saves the tokens in the keyring of the OS, which is the
+// Secret Service on Linux, by the name of their token file.
+type keyringTokenStore struct{}
+
+func (s keyringTokenStore) Load(path string) ([]byte, error) {
+	secret, err := keyring.Get(keyringService, filepath.Base(path))
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token from keyring: %v", err)
+	}
+	return []byte(secret), nil
+}
+
+func (s keyringTokenStore) Save(path string, content []byte) error {
+	if err := keyring.Set(keyringService, filepath.Base(path), string(content)); err != nil {
+		return fmt.Errorf("unable to save token in keyring: %v", err)
+	}
+	return nil
+}
+
+func (s keyringTokenStore) Delete(path string) error {
+	err := keyring.Delete(keyringService, filepath.Base(path))
+	if errors.Is(err, keyring.ErrNotFound) {
+		return fs.ErrNotExist
+	}
+	if err != nil {
+		return fmt.Errorf("unable to delete token from keyring: %v", err)
+	}
+	return nil
+}
+
+func (s keyringTokenStore) Location(path string) string {
+	return fmt.Sprintf("keyring: %v/%v", keyringService, filepath.Base(path))
+}
+
+// migratingTokenStore moves a token saved in a plaintext token file by an
+// earlier version into the store, the first time it is loaded.
+type migratingTokenStore struct {
+	TokenStore
+}
+
+func (s migratingTokenStore) Load(path string) ([]byte, error) {
+	content, err := s.TokenStore.Load(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return content, err
+	}
+	content, err = fileTokenStore{}.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithField("tokenFile", path).WithField("location", s.Location(path)).Info("moving token from plaintext file into the token store")
+	if err := s.TokenStore.Save(path, content); err != nil {
+		return nil, fmt.Errorf("unable to move token into the token store: %v", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("unable to delete plaintext token file after moving it into the token store: %v", err)
+	}
+	return content, nil
+}
+
+// Delete deletes the token from the store along with any plaintext token file
+// not moved into the store yet.
+func (s migratingTokenStore) Delete(path string) error {
+	storeErr := s.TokenStore.Delete(path)
+	fileErr := os.Remove(path)
+	if fileErr != nil && !errors.Is(fileErr, fs.ErrNotExist) {
+		return fileErr
+	}
+	if fileErr == nil && errors.Is(storeErr, fs.ErrNotExist) {
+		return nil
+	}
+	return storeErr
+}
+
+// NewTokenStore creates the token store of the kind, which is a plaintext
+// file, a file encrypted using the passphrase or the keyring of the OS. Tokens
+// in plaintext files are moved into the other stores when loaded.
+func NewTokenStore(kind string, passphrase string) (TokenStore, error) {
+	switch kind {
+	case constants.TOKEN_STORE_FILE:
+		return fileTokenStore{}, nil
+	case constants.TOKEN_STORE_ENCRYPTED_FILE:
+		if passphrase == "" {
+			return nil, errors.New("passphrase of the encrypted token file is not set")
+		}
+		return migratingTokenStore{encryptedFileTokenStore{passphrase}}, nil
+	case constants.TOKEN_STORE_KEYRING:
+		return migratingTokenStore{keyringTokenStore{}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported token store: %v", kind)
+	}
+}
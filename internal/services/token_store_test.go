@@ -0,0 +1,88 @@
+package services_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestEncryptedFileTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	store, err := services.NewTokenStore(constants.TOKEN_STORE_ENCRYPTED_FILE, "secret")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Save(path, []byte(`{"refresh_token":"refresh"}`)))
+	content, err := store.Load(path)
+
+	require.NoError(t, err)
+	assert.Equal(t, `{"refresh_token":"refresh"}`, string(content))
+	assert.Equal(t, path+".enc", store.Location(path))
+	encrypted, err := os.ReadFile(path + ".enc")
+	require.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "refresh")
+	assert.NoFileExists(t, path)
+
+	otherStore, err := services.NewTokenStore(constants.TOKEN_STORE_ENCRYPTED_FILE, "other")
+	require.NoError(t, err)
+	_, err = otherStore.Load(path)
+	assert.EqualError(t, err, "unable to decrypt token file, check the passphrase: "+path+".enc")
+
+	require.NoError(t, store.Delete(path))
+	_, err = store.Load(path)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.ErrorIs(t, store.Delete(path), fs.ErrNotExist)
+}
+
+func TestEncryptedFileTokenStoreMigratesPlaintextToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"refresh_token":"refresh"}`), 0600))
+	store, err := services.NewTokenStore(constants.TOKEN_STORE_ENCRYPTED_FILE, "secret")
+	require.NoError(t, err)
+
+	content, err := store.Load(path)
+
+	require.NoError(t, err)
+	assert.Equal(t, `{"refresh_token":"refresh"}`, string(content))
+	assert.NoFileExists(t, path)
+	content, err = store.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"refresh_token":"refresh"}`, string(content))
+}
+
+func TestNewTokenStore(t *testing.T) {
+	_, err := services.NewTokenStore(constants.TOKEN_STORE_ENCRYPTED_FILE, "")
+	assert.EqualError(t, err, "passphrase of the encrypted token file is not set")
+
+	_, err = services.NewTokenStore("vault", "")
+	assert.EqualError(t, err, "unsupported token store: vault")
+}
+
+func TestNewGmailServiceWrongPassphrase(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+	path := filepath.Join(home, constants.GOOGLE_TOKEN_FILE)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	store, err := services.NewTokenStore(constants.TOKEN_STORE_ENCRYPTED_FILE, "secret")
+	require.NoError(t, err)
+	require.NoError(t, store.Save(path, []byte(`{"access_token":"access","refresh_token":"refresh"}`)))
+	otherStore, err := services.NewTokenStore(constants.TOKEN_STORE_ENCRYPTED_FILE, "other")
+	require.NoError(t, err)
+	credentials := []byte(`{"installed":{"client_id":"sodexwoe","redirect_uris":["http://localhost"]}}`)
+
+	_, err = services.NewGmailService(credentials, otherStore, services.GoogleAccount{}, true, gmail.GmailReadonlyScope)
+
+	assert.EqualError(t, err, "unable to decrypt token file, check the passphrase: "+path+".enc")
+	content, err := store.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"access_token":"access","refresh_token":"refresh"}`, string(content))
+}
@@ -0,0 +1,221 @@
+package testutils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matcher reports whether a message matches a Gmail search query.
+type matcher func(m *GmailMessage, labelName func(id string) string) bool
+
+// parseGmailQuery parses the subset of the Gmail search syntax used by
+// sodexwoe: label, from, subject, filename, has:attachment, after, before
+// and larger terms combined using OR, - and parentheses.
+func parseGmailQuery(q string) (matcher, error) {
+	p := &queryParser{tokens: tokenizeGmailQuery(q)}
+	if len(p.tokens) == 0 {
+		return func(*GmailMessage, func(string) string) bool { return true }, nil
+	}
+	m, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected token in query: %v", p.tokens[p.pos])
+	}
+	return m, nil
+}
+
+func tokenizeGmailQuery(q string) []string {
+	tokens := make([]string, 0)
+	var token strings.Builder
+	quoted := false
+	flush := func() {
+		if token.Len() > 0 {
+			tokens = append(tokens, token.String())
+			token.Reset()
+		}
+	}
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			token.WriteRune(r)
+		case quoted:
+			token.WriteRune(r)
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t':
+			flush()
+		default:
+			token.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) or() (matcher, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m *GmailMessage, labelName func(string) string) bool {
+			return l(m, labelName) || right(m, labelName)
+		}
+	}
+	return left, nil
+}
+
+func (p *queryParser) and() (matcher, error) {
+	matchers := make([]matcher, 0)
+	for token := p.peek(); token != "" && token != ")" && token != "OR"; token = p.peek() {
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("empty query expression at token: %v", p.pos)
+	}
+	return func(m *GmailMessage, labelName func(string) string) bool {
+		for _, match := range matchers {
+			if !match(m, labelName) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func (p *queryParser) unary() (matcher, error) {
+	token := p.peek()
+	switch {
+	case token == "(":
+		p.pos++
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) in query")
+		}
+		p.pos++
+		return m, nil
+	case strings.HasPrefix(token, "-") && len(token) > 1:
+		p.tokens[p.pos] = token[1:]
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(message *GmailMessage, labelName func(string) string) bool { return !m(message, labelName) }, nil
+	case token == "-":
+		p.pos++
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(message *GmailMessage, labelName func(string) string) bool { return !m(message, labelName) }, nil
+	default:
+		p.pos++
+		return parseGmailTerm(token)
+	}
+}
+
+func parseGmailTerm(token string) (matcher, error) {
+	key, value, ok := strings.Cut(token, ":")
+	if !ok {
+		return nil, fmt.Errorf("unsupported query term: %v", token)
+	}
+	value = strings.ToLower(strings.Trim(value, "\""))
+
+	switch strings.ToLower(key) {
+	case "label":
+		return func(m *GmailMessage, labelName func(string) string) bool {
+			for _, id := range m.LabelIds {
+				if normalizeLabel(labelName(id)) == normalizeLabel(value) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "from":
+		return func(m *GmailMessage, _ func(string) string) bool {
+			return strings.Contains(strings.ToLower(m.From), value)
+		}, nil
+	case "subject":
+		return func(m *GmailMessage, _ func(string) string) bool {
+			return strings.Contains(strings.ToLower(m.Subject), value)
+		}, nil
+	case "filename":
+		return func(m *GmailMessage, _ func(string) string) bool {
+			for _, a := range m.Attachments {
+				filename := strings.ToLower(a.Filename)
+				if strings.TrimPrefix(filepath.Ext(filename), ".") == value || strings.Contains(filename, value) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "has":
+		if value != "attachment" {
+			return nil, fmt.Errorf("unsupported query term: %v", token)
+		}
+		return func(m *GmailMessage, _ func(string) string) bool { return len(m.Attachments) > 0 }, nil
+	case "after", "before":
+		t, err := parseGmailQueryTime(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query term: %v: %v", token, err)
+		}
+		if key == "after" {
+			return func(m *GmailMessage, _ func(string) string) bool { return m.Received.After(t) }, nil
+		}
+		return func(m *GmailMessage, _ func(string) string) bool { return m.Received.Before(t) }, nil
+	case "larger":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query term: %v: %v", token, err)
+		}
+		return func(m *GmailMessage, _ func(string) string) bool { return m.size() > size }, nil
+	default:
+		return nil, fmt.Errorf("unsupported query term: %v", token)
+	}
+}
+
+// parseGmailQueryTime parses an epoch in seconds or a date like 2024/04/01.
+func parseGmailQueryTime(value string) (time.Time, error) {
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(epoch, 0), nil
+	}
+	return time.Parse("2006/01/02", value)
+}
+
+// normalizeLabel normalizes a label name as Gmail does for search, where
+// spaces and slashes are written as hyphens.
+func normalizeLabel(name string) string {
+	return strings.NewReplacer(" ", "-", "/", "-").Replace(strings.ToLower(name))
+}
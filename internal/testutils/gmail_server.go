@@ -0,0 +1,571 @@
+package testutils
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	gmailPathPrefix      = "/gmail/v1/users/me/"
+	gmailInboxLabelId    = "INBOX"
+	gmailDefaultPageSize = 100
+)
+
+// GmailMessage is an email in the fake Gmail mailbox.
+type GmailMessage struct {
+	Id          string
+	LabelIds    []string
+	From        string
+	Subject     string
+	Received    time.Time
+	Attachments []GmailAttachment
+}
+
+// GmailAttachment is an attachment of an email in the fake Gmail mailbox.
+type GmailAttachment struct {
+	Filename string
+	MimeType string
+	Data     []byte
+}
+
+func (m *GmailMessage) size() int {
+	size := len(m.Subject)
+	for _, a := range m.Attachments {
+		size += len(a.Data)
+	}
+	return size
+}
+
+type gmailHistory struct {
+	id          uint64
+	messageId   string
+	labelIds    []string
+	labelsAdded bool
+}
+
+// GmailServer is an in-process fake of the Gmail REST API endpoints used by
+// sodexwoe: labels, filters, messages list, get and modify, attachments,
+// profile and history.
+type GmailServer struct {
+	*httptest.Server
+	// PageSize is the number of messages or history records listed in a page.
+	PageSize int
+	// Queries has the search queries of the listed messages, in order.
+	Queries []string
+
+	mu             sync.Mutex
+	labels         []*gmail.Label
+	filters        []*gmail.Filter
+	messages       []*GmailMessage
+	history        []gmailHistory
+	historyId      uint64
+	minHistoryId   uint64
+	nextLabelId    int
+	nextMessageId  int
+	forbidModifies bool
+	forbidAll      bool
+}
+
+// AddLabel adds a user label to the mailbox, returning its id.
+func (s *GmailServer) AddLabel(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addLabel(name).Id
+}
+
+func (s *GmailServer) addLabel(name string) *gmail.Label {
+	s.nextLabelId++
+	label := &gmail.Label{Id: fmt.Sprintf("Label_%d", s.nextLabelId), Name: name, Type: "user"}
+	s.labels = append(s.labels, label)
+	return label
+}
+
+// AddMessage adds an email to the inbox having the labels of the given names,
+// returning its id. The labels are created when required.
+func (s *GmailServer) AddMessage(message GmailMessage, labelNames ...string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextMessageId++
+	m := message
+	if m.Id == "" {
+		m.Id = fmt.Sprintf("msg-%03d", s.nextMessageId)
+	}
+	m.LabelIds = []string{gmailInboxLabelId}
+	for _, name := range labelNames {
+		label := s.labelByName(name)
+		if label == nil {
+			label = s.addLabel(name)
+		}
+		m.LabelIds = append(m.LabelIds, label.Id)
+	}
+	s.messages = append(s.messages, &m)
+	s.addHistory(m.Id, m.LabelIds, false)
+
+	return m.Id
+}
+
+// RemoveMessage deletes an email from the mailbox.
+func (s *GmailServer) RemoveMessage(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, m := range s.messages {
+		if m.Id == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			return
+		}
+	}
+}
+
+// LabelNames returns the names of the labels of an email.
+func (s *GmailServer) LabelNames(id string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.message(id)
+	if m == nil {
+		return nil
+	}
+	names := make([]string, 0, len(m.LabelIds))
+	for _, labelId := range m.LabelIds {
+		names = append(names, s.labelName(labelId))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExpireHistory drops the history records, as Gmail does after about a week.
+func (s *GmailServer) ExpireHistory() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.history = nil
+	s.minHistoryId = s.historyId + 1
+}
+
+// ForbidModifies makes creating labels and modifying emails fail, as they do
+// when signed in with a read only scope.
+func (s *GmailServer) ForbidModifies() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forbidModifies = true
+}
+
+// ForbidAll makes every request fail, as they do when signed in without any of
+// the Gmail scopes.
+func (s *GmailServer) ForbidAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forbidAll = true
+}
+
+// Service returns a Gmail service using the fake server.
+func (s *GmailServer) Service(t *testing.T) *gmail.Service {
+	srv, err := gmail.NewService(context.Background(), option.WithEndpoint(s.URL), option.WithHTTPClient(s.Client()))
+	if err != nil {
+		t.Fatalf("unable to create gmail service: %v", err)
+	}
+	return srv
+}
+
+func (s *GmailServer) addHistory(messageId string, labelIds []string, labelsAdded bool) {
+	s.historyId++
+	s.history = append(s.history, gmailHistory{id: s.historyId, messageId: messageId, labelIds: labelIds, labelsAdded: labelsAdded})
+}
+
+func (s *GmailServer) labelByName(name string) *gmail.Label {
+	for _, label := range s.labels {
+		if label.Name == name {
+			return label
+		}
+	}
+	return nil
+}
+
+func (s *GmailServer) labelName(id string) string {
+	for _, label := range s.allLabels() {
+		if label.Id == id {
+			return label.Name
+		}
+	}
+	return ""
+}
+
+func (s *GmailServer) message(id string) *GmailMessage {
+	for _, m := range s.messages {
+		if m.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *GmailServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, gmailPathPrefix)
+	if path == r.URL.Path {
+		writeGmailError(w, http.StatusNotFound, "unknown path: %v", r.URL.Path)
+		return
+	}
+	if s.forbidAll {
+		writeGmailError(w, http.StatusForbidden, "Request had insufficient authentication scopes.")
+		return
+	}
+	parts := strings.Split(path, "/")
+	switch {
+	case r.Method == http.MethodGet && path == "profile":
+		writeJSON(w, &gmail.Profile{EmailAddress: "me@example.com", HistoryId: s.historyId})
+	case r.Method == http.MethodGet && path == "labels":
+		writeJSON(w, &gmail.ListLabelsResponse{Labels: s.allLabels()})
+	case r.Method == http.MethodPost && path == "labels":
+		s.createLabel(w, r)
+	case r.Method == http.MethodGet && path == "messages":
+		s.listMessages(w, r)
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "messages":
+		s.getMessage(w, parts[1])
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "messages" && parts[2] == "modify":
+		s.modifyMessage(w, r, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[0] == "messages" && parts[2] == "attachments":
+		s.getAttachment(w, parts[1], parts[3])
+	case r.Method == http.MethodPost && path == "messages/batchModify":
+		s.batchModifyMessages(w, r)
+	case r.Method == http.MethodGet && path == "settings/filters":
+		writeJSON(w, &gmail.ListFiltersResponse{Filter: s.filters})
+	case r.Method == http.MethodPost && path == "settings/filters":
+		s.createFilter(w, r)
+	case r.Method == http.MethodGet && path == "history":
+		s.listHistory(w, r)
+	default:
+		writeGmailError(w, http.StatusNotFound, "unknown path: %v %v", r.Method, r.URL.Path)
+	}
+}
+
+func (s *GmailServer) allLabels() []*gmail.Label {
+	labels := []*gmail.Label{{Id: gmailInboxLabelId, Name: gmailInboxLabelId, Type: "system"}}
+	return append(labels, s.labels...)
+}
+
+func (s *GmailServer) createLabel(w http.ResponseWriter, r *http.Request) {
+	if s.forbidModifies {
+		writeGmailError(w, http.StatusForbidden, "Request had insufficient authentication scopes.")
+		return
+	}
+	var label gmail.Label
+	if err := json.NewDecoder(r.Body).Decode(&label); err != nil {
+		writeGmailError(w, http.StatusBadRequest, "invalid label: %v", err)
+		return
+	}
+	if s.labelByName(label.Name) != nil {
+		writeGmailError(w, http.StatusConflict, "Label name exists or conflicts")
+		return
+	}
+	writeJSON(w, s.addLabel(label.Name))
+}
+
+func (s *GmailServer) listMessages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	match, err := parseGmailQuery(q)
+	if err != nil {
+		writeGmailError(w, http.StatusBadRequest, "Invalid query: %v", err)
+		return
+	}
+	if r.URL.Query().Get("pageToken") == "" {
+		s.Queries = append(s.Queries, q)
+	}
+
+	ids := make([]string, 0)
+	// Gmail lists the latest emails first
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if match(s.messages[i], s.labelName) {
+			ids = append(ids, s.messages[i].Id)
+		}
+	}
+	page, nextPageToken, err := s.page(ids, r.URL.Query().Get("pageToken"))
+	if err != nil {
+		writeGmailError(w, http.StatusBadRequest, "Invalid pageToken")
+		return
+	}
+
+	res := &gmail.ListMessagesResponse{NextPageToken: nextPageToken, ResultSizeEstimate: int64(len(ids))}
+	for _, id := range page {
+		res.Messages = append(res.Messages, &gmail.Message{Id: id, ThreadId: id})
+	}
+	writeJSON(w, res)
+}
+
+func (s *GmailServer) page(ids []string, pageToken string) ([]string, string, error) {
+	pageSize := s.PageSize
+	if pageSize <= 0 {
+		pageSize = gmailDefaultPageSize
+	}
+	start := 0
+	if pageToken != "" {
+		var err error
+		if start, err = strconv.Atoi(pageToken); err != nil || start > len(ids) {
+			return nil, "", fmt.Errorf("invalid page token: %v", pageToken)
+		}
+	}
+	end := start + pageSize
+	if end >= len(ids) {
+		return ids[start:], "", nil
+	}
+	return ids[start:end], strconv.Itoa(end), nil
+}
+
+func (s *GmailServer) getMessage(w http.ResponseWriter, id string) {
+	m := s.message(id)
+	if m == nil {
+		writeGmailError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+
+	payload := &gmail.MessagePart{
+		PartId:   "",
+		MimeType: "multipart/mixed",
+		Headers: []*gmail.MessagePartHeader{
+			{Name: "From", Value: m.From},
+			{Name: "Subject", Value: m.Subject},
+			{Name: "Date", Value: m.Received.Format(time.RFC1123Z)},
+		},
+		Parts: []*gmail.MessagePart{{
+			PartId:   "0",
+			MimeType: "text/plain",
+			Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("Your bill is attached.")), Size: 22},
+		}},
+	}
+	for i, a := range m.Attachments {
+		mimeType := a.MimeType
+		if mimeType == "" {
+			mimeType = "application/pdf"
+		}
+		payload.Parts = append(payload.Parts, &gmail.MessagePart{
+			PartId:   strconv.Itoa(i + 1),
+			MimeType: mimeType,
+			Filename: a.Filename,
+			Body:     &gmail.MessagePartBody{AttachmentId: attachmentId(m.Id, i), Size: int64(len(a.Data))},
+		})
+	}
+	writeJSON(w, &gmail.Message{
+		Id:           m.Id,
+		ThreadId:     m.Id,
+		LabelIds:     m.LabelIds,
+		InternalDate: m.Received.UnixMilli(),
+		SizeEstimate: int64(m.size()),
+		Payload:      payload,
+	})
+}
+
+func (s *GmailServer) modifyMessage(w http.ResponseWriter, r *http.Request, id string) {
+	if s.forbidModifies {
+		writeGmailError(w, http.StatusForbidden, "Request had insufficient authentication scopes.")
+		return
+	}
+	m := s.message(id)
+	if m == nil {
+		writeGmailError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	var req gmail.ModifyMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeGmailError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	if !s.validLabels(req.AddLabelIds) {
+		writeGmailError(w, http.StatusBadRequest, "Invalid label: %v", req.AddLabelIds)
+		return
+	}
+
+	s.modify(m, req.AddLabelIds, req.RemoveLabelIds)
+	writeJSON(w, &gmail.Message{Id: m.Id, ThreadId: m.Id, LabelIds: m.LabelIds})
+}
+
+func (s *GmailServer) batchModifyMessages(w http.ResponseWriter, r *http.Request) {
+	if s.forbidModifies {
+		writeGmailError(w, http.StatusForbidden, "Request had insufficient authentication scopes.")
+		return
+	}
+	var req gmail.BatchModifyMessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeGmailError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	if len(req.Ids) > 1000 || !s.validLabels(req.AddLabelIds) {
+		writeGmailError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	for _, id := range req.Ids {
+		if m := s.message(id); m != nil {
+			s.modify(m, req.AddLabelIds, req.RemoveLabelIds)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *GmailServer) validLabels(labelIds []string) bool {
+	for _, labelId := range labelIds {
+		if s.labelName(labelId) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *GmailServer) modify(m *GmailMessage, addLabelIds, removeLabelIds []string) {
+	labelIds := make([]string, 0, len(m.LabelIds))
+	for _, labelId := range m.LabelIds {
+		if !contains(removeLabelIds, labelId) && !contains(addLabelIds, labelId) {
+			labelIds = append(labelIds, labelId)
+		}
+	}
+	m.LabelIds = append(labelIds, addLabelIds...)
+	if len(addLabelIds) > 0 {
+		s.addHistory(m.Id, addLabelIds, true)
+	}
+}
+
+// Filters returns the filters created in the mailbox.
+func (s *GmailServer) Filters() []*gmail.Filter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*gmail.Filter{}, s.filters...)
+}
+
+func (s *GmailServer) createFilter(w http.ResponseWriter, r *http.Request) {
+	if s.forbidModifies {
+		writeGmailError(w, http.StatusForbidden, "Request had insufficient authentication scopes.")
+		return
+	}
+	var filter gmail.Filter
+	if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+		writeGmailError(w, http.StatusBadRequest, "invalid filter: %v", err)
+		return
+	}
+	if filter.Criteria == nil || filter.Action == nil || !s.validLabels(filter.Action.AddLabelIds) {
+		writeGmailError(w, http.StatusBadRequest, "Invalid filter")
+		return
+	}
+
+	filter.Id = fmt.Sprintf("filter-%d", len(s.filters)+1)
+	s.filters = append(s.filters, &filter)
+	writeJSON(w, &filter)
+}
+
+func (s *GmailServer) getAttachment(w http.ResponseWriter, messageId, id string) {
+	m := s.message(messageId)
+	if m == nil {
+		writeGmailError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	for i, a := range m.Attachments {
+		if attachmentId(m.Id, i) == id {
+			writeJSON(w, &gmail.MessagePartBody{
+				AttachmentId: id,
+				Size:         int64(len(a.Data)),
+				Data:         base64.URLEncoding.EncodeToString(a.Data),
+			})
+			return
+		}
+	}
+	writeGmailError(w, http.StatusNotFound, "Requested entity was not found.")
+}
+
+func (s *GmailServer) listHistory(w http.ResponseWriter, r *http.Request) {
+	startHistoryId, err := strconv.ParseUint(r.URL.Query().Get("startHistoryId"), 10, 64)
+	if err != nil {
+		writeGmailError(w, http.StatusBadRequest, "Invalid startHistoryId")
+		return
+	}
+	if startHistoryId < s.minHistoryId {
+		writeGmailError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	labelId := r.URL.Query().Get("labelId")
+
+	records := make([]string, 0)
+	byId := make(map[string]gmailHistory)
+	for _, h := range s.history {
+		if h.id <= startHistoryId || labelId != "" && !contains(h.labelIds, labelId) {
+			continue
+		}
+		id := strconv.FormatUint(h.id, 10)
+		records = append(records, id)
+		byId[id] = h
+	}
+	page, nextPageToken, err := s.page(records, r.URL.Query().Get("pageToken"))
+	if err != nil {
+		writeGmailError(w, http.StatusBadRequest, "Invalid pageToken")
+		return
+	}
+
+	res := &gmail.ListHistoryResponse{HistoryId: s.historyId, NextPageToken: nextPageToken}
+	for _, id := range page {
+		h := byId[id]
+		record := &gmail.History{Id: h.id}
+		message := &gmail.Message{Id: h.messageId, ThreadId: h.messageId, LabelIds: h.labelIds}
+		if h.labelsAdded {
+			record.LabelsAdded = []*gmail.HistoryLabelAdded{{LabelIds: h.labelIds, Message: message}}
+		} else {
+			record.MessagesAdded = []*gmail.HistoryMessageAdded{{Message: message}}
+		}
+		res.History = append(res.History, record)
+	}
+	writeJSON(w, res)
+}
+
+func attachmentId(messageId string, index int) string {
+	return fmt.Sprintf("%s-attachment-%d", messageId, index+1)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeGmailError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	message := fmt.Sprintf(format, args...)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message, "errors": []map[string]string{{"message": message}}},
+	})
+}
+
+// NewGmailServer starts a fake Gmail server having an empty mailbox, that is
+// closed when the test completes.
+func NewGmailServer(t *testing.T) *GmailServer {
+	s := &GmailServer{historyId: 1000, minHistoryId: 1}
+	s.Server = httptest.NewServer(s)
+	t.Cleanup(s.Close)
+
+	return s
+}
@@ -0,0 +1,61 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/require"
+)
+
+// Email builds a MIME email having the PDF attachment unless the filename is
+// empty.
+func Email(date time.Time, from, subject, filename string, content []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprint(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprint(&b, "Content-Type: multipart/mixed; boundary=\"boundary\"\r\n\r\n")
+	fmt.Fprint(&b, "--boundary\r\nContent-Type: text/plain\r\n\r\nYour bill is attached.\r\n")
+	if filename != "" {
+		fmt.Fprint(&b, "--boundary\r\nContent-Type: application/pdf\r\n")
+		fmt.Fprintf(&b, "Content-Disposition: attachment; filename=\"%s\"\r\n", filename)
+		fmt.Fprint(&b, "Content-Transfer-Encoding: base64\r\n\r\n")
+		fmt.Fprintf(&b, "%s\r\n", base64.StdEncoding.EncodeToString(content))
+	}
+	fmt.Fprint(&b, "--boundary--\r\n")
+	return b.Bytes()
+}
+
+// StartIMAPServer starts an in-memory IMAP server having the given emails by
+// folder, each appended with its received time.
+func StartIMAPServer(t *testing.T, folders map[string]map[time.Time][]byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	c, err := client.Dial(l.Addr().String())
+	require.NoError(t, err)
+	defer c.Logout()
+	require.NoError(t, c.Login("username", "password"))
+	for folder, emails := range folders {
+		if folder != "INBOX" {
+			require.NoError(t, c.Create(folder))
+		}
+		for received, email := range emails {
+			require.NoError(t, c.Append(folder, nil, received, bytes.NewBuffer(email)))
+		}
+	}
+
+	return l.Addr().String()
+}
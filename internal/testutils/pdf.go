@@ -0,0 +1,47 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	pdfcpuapi "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// BillPDF generates a bill PDF having the given number of pages, each with
+// its page number, encrypted using the password unless it is empty.
+func BillPDF(t *testing.T, title string, pages int, password string) []byte {
+	content := make(map[string]interface{}, pages)
+	for page := 1; page <= pages; page++ {
+		content[fmt.Sprint(page)] = map[string]interface{}{
+			"content": map[string]interface{}{
+				"text": []map[string]interface{}{{
+					"value":  fmt.Sprintf("%s - page %d of %d", title, page, pages),
+					"anchor": "center",
+					"font":   map[string]interface{}{"name": "Helvetica", "size": 24},
+				}},
+			},
+		}
+	}
+	spec, err := json.Marshal(map[string]interface{}{"paper": "A4", "pages": content})
+	if err != nil {
+		t.Fatalf("unable to create pdf spec: %v", err)
+	}
+
+	var pdf bytes.Buffer
+	if err := pdfcpuapi.CreateFromJSON(bytes.NewReader(spec), nil, &pdf, nil); err != nil {
+		t.Fatalf("unable to create pdf: %v", err)
+	}
+	if password == "" {
+		return pdf.Bytes()
+	}
+
+	conf := pdfcpu.NewAESConfiguration(password, password+"-owner", 256)
+	var encrypted bytes.Buffer
+	if err := pdfcpuapi.Encrypt(bytes.NewReader(pdf.Bytes()), &encrypted, conf); err != nil {
+		t.Fatalf("unable to encrypt pdf: %v", err)
+	}
+	return encrypted.Bytes()
+}
@@ -12,3 +12,13 @@ func CreateFile(path string) (*os.File, error) {
 
 	return os.Create(path)
 }
+
+// CreateTempFile creates a temporary file next to path, creating the parent
+// directories when required.
+func CreateTempFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	return os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+}
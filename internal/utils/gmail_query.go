@@ -2,21 +2,217 @@ package utils
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
-	"time"
 )
 
-func AnyLabelQ(labelNames ...string) string {
-	labelQs := make([]string, 0, len(labelNames))
+// Query is a node of a Gmail search query, rendered by Render using the Gmail
+// search operators, see https://support.google.com/mail/answer/7190.
+type Query interface {
+	render() (string, error)
+}
+
+// Render renders the query, failing when any of its terms has a value that
+// cannot be expressed in a Gmail search rather than leaving the term out and
+// broadening the query.
+func Render(q Query) (string, error) {
+	if q == nil {
+		return "", nil
+	}
+	return q.render()
+}
+
+type term struct {
+	operator string
+	value    string
+}
+
+func (t term) render() (string, error) {
+	return fmt.Sprintf("%s:%s", t.operator, t.value), nil
+}
+
+type and []Query
+
+func (a and) render() (string, error) {
+	qs, err := renderAll(a)
+	return strings.Join(qs, " "), err
+}
+
+type or []Query
+
+func (o or) render() (string, error) {
+	qs, err := renderAll(o)
+	if err != nil || len(qs) == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("(%s)", strings.Join(qs, " OR ")), nil
+}
+
+type not struct {
+	Query
+}
+
+func (n not) render() (string, error) {
+	s, err := grouped(n.Query)
+	if err != nil || s == "" {
+		return "", err
+	}
+	return "-" + s, nil
+}
+
+type raw string
+
+func (r raw) render() (string, error) {
+	s := strings.TrimSpace(string(r))
+	if s == "" {
+		return "", nil
+	}
+	return fmt.Sprintf("(%s)", s), nil
+}
+
+// invalid is a term having a value that cannot be expressed in a Gmail search.
+type invalid struct {
+	err error
+}
+
+func (i invalid) render() (string, error) {
+	return "", i.err
+}
+
+// renderAll renders the non-empty queries, each grouped to bind as a single
+// term.
+func renderAll(qs []Query) ([]string, error) {
+	rendered := make([]string, 0, len(qs))
+	for _, q := range qs {
+		s, err := grouped(q)
+		if err != nil {
+			return nil, err
+		}
+		if s != "" {
+			rendered = append(rendered, s)
+		}
+	}
+	return rendered, nil
+}
+
+// grouped renders q wrapped in parentheses when it is made of more than one
+// space separated term, so that it binds as a single term in its parent.
+func grouped(q Query) (string, error) {
+	a, ok := q.(and)
+	if !ok {
+		return Render(q)
+	}
+	qs, err := renderAll(a)
+	if err != nil {
+		return "", err
+	}
+	if len(qs) > 1 {
+		return fmt.Sprintf("(%s)", strings.Join(qs, " ")), nil
+	}
+	return strings.Join(qs, " "), nil
+}
+
+// quote wraps value in double quotes. Gmail search has no way to escape a
+// double quote inside a quoted value, so such values are invalid.
+func quote(operator, value string) Query {
+	if strings.Contains(value, `"`) {
+		return invalid{fmt.Errorf("%s cannot contain a double quote in a Gmail search: %s", operator, value)}
+	}
+	return term{operator, fmt.Sprintf("\"%s\"", strings.Join(strings.Fields(value), " "))}
+}
+
+// labelSeparators are written as hyphens in the label names of a Gmail search,
+// as the Gmail search box does on clicking a label, e.g. label:bills-airtel
+// for the nested label Bills/Airtel. Gmail is not known to rewrite any other
+// character, so the others are kept as they are.
+var labelSeparators = strings.NewReplacer(" ", "-", "/", "-")
+
+func And(qs ...Query) Query {
+	return and(qs)
+}
+
+func Or(qs ...Query) Query {
+	return or(qs)
+}
+
+func Not(q Query) Query {
+	return not{q}
+}
+
+// Raw is a free-form query fragment that is used as is.
+func Raw(fragment string) Query {
+	return raw(fragment)
+}
+
+// Label renders the label name the way Gmail normalizes it for search, which
+// needs no quoting. Label names containing characters of the search syntax
+// cannot be expressed in a Gmail search.
+func Label(name string) Query {
+	if strings.ContainsAny(name, `"(){}`) {
+		return invalid{fmt.Errorf("label cannot contain any of \"(){} in a Gmail search: %s", name)}
+	}
+	return term{"label", labelSeparators.Replace(strings.ToLower(name))}
+}
+
+func From(sender string) Query {
+	return quote("from", sender)
+}
+
+func Subject(subject string) Query {
+	return quote("subject", subject)
+}
+
+func Filename(name string) Query {
+	return quote("filename", name)
+}
+
+func HasAttachment() Query {
+	return term{"has", "attachment"}
+}
+
+// After matches emails received after the given epoch seconds.
+func After(epochSeconds int64) Query {
+	return term{"after", strconv.FormatInt(epochSeconds, 10)}
+}
+
+// Before matches emails received before the given epoch seconds.
+func Before(epochSeconds int64) Query {
+	return term{"before", strconv.FormatInt(epochSeconds, 10)}
+}
+
+// Larger matches emails larger than the given size in bytes.
+func Larger(bytes int64) Query {
+	return term{"larger", strconv.FormatInt(bytes, 10)}
+}
+
+func AnyLabelQ(labelNames ...string) Query {
+	labelQs := make([]Query, 0, len(labelNames))
 	for _, labelName := range labelNames {
-		labelQs = append(labelQs, fmt.Sprintf("label:\"%s\"", labelName))
+		labelQs = append(labelQs, Label(labelName))
 	}
-	return fmt.Sprintf("(%s)", strings.Join(labelQs, " OR "))
+	return Or(labelQs...)
+}
+
+// WithinPeriodQ matches emails received within the period. Gmail treats both
+// after: and before: as exclusive, so the start is moved back by a second to
+// include emails received exactly at the start of the period.
+func WithinPeriodQ(period Period) Query {
+	return And(After(period.Start.Unix()-1), Before(period.End.Unix()))
 }
 
-func WithinMonthQ(year int, month time.Month) string {
-	layout := "2006/01/02"
-	afterDate := StartOfMonth(year, month)
-	beforeDate := EndOfMonth(year, month)
-	return fmt.Sprintf("after:%s before:%s", afterDate.Format(layout), beforeDate.Format(layout))
+func BillRulesQ(from, subject string, hasAttachment bool, fragments ...string) Query {
+	qs := make([]Query, 0, 3+len(fragments))
+	if from != "" {
+		qs = append(qs, From(from))
+	}
+	if subject != "" {
+		qs = append(qs, Subject(subject))
+	}
+	if hasAttachment {
+		qs = append(qs, HasAttachment())
+	}
+	for _, fragment := range fragments {
+		qs = append(qs, Raw(fragment))
+	}
+	return And(qs...)
 }
@@ -8,42 +8,139 @@ import (
 
 	"github.com/arunvelsriram/sodexwoe/internal/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func TestQuery(t *testing.T) {
+	params := []struct {
+		name          string
+		query         utils.Query
+		expectedQuery string
+	}{
+		{"Label", utils.Label("Postpaid Bills/Airtel"), "label:postpaid-bills-airtel"},
+		{"LabelWithSpecialCharacters", utils.Label("Bills & Co. 2024"), "label:bills-&-co.-2024"},
+		{"LabelUnicode", utils.Label("Factures/Électricité"), "label:factures-électricité"},
+		{"From", utils.From("ebill@airtel.com"), "from:\"ebill@airtel.com\""},
+		{"Subject", utils.Subject("Your  Jio Bill"), "subject:\"Your Jio Bill\""},
+		{"Filename", utils.Filename("bill.pdf"), "filename:\"bill.pdf\""},
+		{"HasAttachment", utils.HasAttachment(), "has:attachment"},
+		{"After", utils.After(1648751400), "after:1648751400"},
+		{"Before", utils.Before(1651343400), "before:1651343400"},
+		{"Larger", utils.Larger(1024), "larger:1024"},
+		{"Raw", utils.Raw(" from:a OR from:b "), "(from:a OR from:b)"},
+		{"EmptyRaw", utils.Raw(" "), ""},
+		{"And", utils.And(utils.From("a"), utils.HasAttachment()), "from:\"a\" has:attachment"},
+		{"AndSingle", utils.And(utils.From("a")), "from:\"a\""},
+		{"AndEmpty", utils.And(), ""},
+		{"AndSkipsEmpty", utils.And(utils.Raw(""), nil, utils.From("a")), "from:\"a\""},
+		{"Or", utils.Or(utils.Label("a"), utils.Label("b")), "(label:a OR label:b)"},
+		{"OrSingle", utils.Or(utils.Label("a")), "(label:a)"},
+		{"OrEmpty", utils.Or(), ""},
+		{"OrOfAnd", utils.Or(utils.And(utils.From("a"), utils.Subject("b")), utils.Label("c")), "((from:\"a\" subject:\"b\") OR label:c)"},
+		{"AndOfOr", utils.And(utils.Or(utils.Label("a"), utils.Label("b")), utils.After(1)), "(label:a OR label:b) after:1"},
+		{"Not", utils.Not(utils.Label("a")), "-label:a"},
+		{"NotAnd", utils.Not(utils.And(utils.From("a"), utils.Larger(10))), "-(from:\"a\" larger:10)"},
+		{"NotEmpty", utils.Not(utils.And()), ""},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			actualQuery, err := utils.Render(param.query)
+
+			require.NoError(t, err)
+			assert.Equal(t, param.expectedQuery, actualQuery)
+		})
+	}
+}
+
+func TestRenderInvalid(t *testing.T) {
+	params := []struct {
+		name          string
+		query         utils.Query
+		expectedError string
+	}{
+		{"LabelWithQuote", utils.Label(`My "Bills"`), `label cannot contain any of "(){} in a Gmail search: My "Bills"`},
+		{"LabelWithParentheses", utils.Or(utils.Label("Bills (2024)")), `label cannot contain any of "(){} in a Gmail search: Bills (2024)`},
+		{"FromWithQuote", utils.From(`"Airtel" <ebill@airtel.com>`), `from cannot contain a double quote in a Gmail search: "Airtel" <ebill@airtel.com>`},
+		{"SubjectWithQuoteInAnd", utils.And(utils.Label("a"), utils.Subject(`Your "Jio" bill`)), `subject cannot contain a double quote in a Gmail search: Your "Jio" bill`},
+		{"FilenameWithQuoteInNotOr", utils.Not(utils.Or(utils.Filename(`"bill".pdf`))), `filename cannot contain a double quote in a Gmail search: "bill".pdf`},
+		{"FromWithQuoteInGroupedAnd", utils.Or(utils.Label("a"), utils.And(utils.Label("b"), utils.From(`"Jio"`))), `from cannot contain a double quote in a Gmail search: "Jio"`},
+		{"BillRulesWithQuote", utils.BillRulesQ(`"Airtel"`, "", true), `from cannot contain a double quote in a Gmail search: "Airtel"`},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			actualQuery, err := utils.Render(param.query)
+
+			assert.EqualError(t, err, param.expectedError)
+			assert.Empty(t, actualQuery)
+		})
+	}
+}
+
 func TestAnyLabelQ(t *testing.T) {
 	params := []struct {
 		labelNames    []string
 		expectedQuery string
 	}{
-		{[]string{"airtel"}, "(label:\"airtel\")"},
-		{[]string{"Jio", "Postpaid Bill / Airtel"}, "(label:\"Jio\" OR label:\"Postpaid Bill / Airtel\")"},
+		{[]string{"airtel"}, "(label:airtel)"},
+		{[]string{"Jio", "Postpaid Bill / Airtel"}, "(label:jio OR label:postpaid-bill---airtel)"},
 	}
 
 	for _, param := range params {
 		t.Run(fmt.Sprintf("LabelNames=%s", strings.Join(param.labelNames, ",")), func(t *testing.T) {
-			actualQuery := utils.AnyLabelQ(param.labelNames...)
+			actualQuery, err := utils.Render(utils.AnyLabelQ(param.labelNames...))
 
+			require.NoError(t, err)
 			assert.Equal(t, param.expectedQuery, actualQuery)
 		})
 	}
 }
 
-func TestWithinMonthQ(t *testing.T) {
+func TestWithinPeriodQ(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	assert.NoError(t, err)
+
 	params := []struct {
 		year          int
 		month         time.Month
+		loc           *time.Location
+		expectedQuery string
+	}{
+		{2022, time.April, time.UTC, "after:1648771199 before:1651363200"},
+		{2020, time.February, time.UTC, "after:1580515199 before:1583020800"},
+		{2022, time.April, kolkata, "after:1648751399 before:1651343400"},
+	}
+
+	for _, param := range params {
+		t.Run(fmt.Sprintf("Year=%d Month=%s Location=%s", param.year, param.month.String(), param.loc), func(t *testing.T) {
+			actualQuery, err := utils.Render(utils.WithinPeriodQ(utils.MonthPeriod(param.year, param.month, param.loc)))
+
+			require.NoError(t, err)
+			assert.Equal(t, param.expectedQuery, actualQuery)
+		})
+	}
+}
+
+func TestBillRulesQ(t *testing.T) {
+	params := []struct {
+		from          string
+		subject       string
+		hasAttachment bool
+		fragments     []string
 		expectedQuery string
 	}{
-		{2022, time.April, "after:2022/04/01 before:2022/04/30"},
-		{2022, time.August, "after:2022/08/01 before:2022/08/31"},
-		{2022, time.February, "after:2022/02/01 before:2022/02/28"},
-		{2020, time.February, "after:2020/02/01 before:2020/02/29"},
+		{"ebill@airtel.com", "", false, nil, "from:\"ebill@airtel.com\""},
+		{"", "Your Jio Bill", true, nil, "subject:\"Your Jio Bill\" has:attachment"},
+		{"ebill@airtel.com", "Bill", true, []string{"filename:pdf", " "}, "from:\"ebill@airtel.com\" subject:\"Bill\" has:attachment (filename:pdf)"},
+		{"", "", false, []string{"from:a OR from:b"}, "(from:a OR from:b)"},
 	}
 
 	for _, param := range params {
-		t.Run(fmt.Sprintf("Year=%d Month=%s", param.year, param.month.String()), func(t *testing.T) {
-			actualQuery := utils.WithinMonthQ(param.year, param.month)
+		t.Run(fmt.Sprintf("From=%s Subject=%s", param.from, param.subject), func(t *testing.T) {
+			actualQuery, err := utils.Render(utils.BillRulesQ(param.from, param.subject, param.hasAttachment, param.fragments...))
 
+			require.NoError(t, err)
 			assert.Equal(t, param.expectedQuery, actualQuery)
 		})
 	}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Period is the half-open time range [Start, End).
+type Period struct {
+	Start time.Time
+	End   time.Time
+}
+
+func MonthPeriod(year int, month time.Month, loc *time.Location) Period {
+	start := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	return Period{Start: start, End: start.AddDate(0, 1, 0)}
+}
+
+func (p Period) Contains(t time.Time) bool {
+	return !t.Before(p.Start) && t.Before(p.End)
+}
+
+func (p Period) Year() int {
+	return p.Start.Year()
+}
+
+func (p Period) Month() time.Month {
+	return p.Start.Month()
+}
+
+// AddMonths returns the period shifted by n months.
+func (p Period) AddMonths(n int) Period {
+	return Period{Start: p.Start.AddDate(0, n, 0), End: p.End.AddDate(0, n, 0)}
+}
+
+func (p Period) String() string {
+	layout := "2006-01-02 15:04:05 MST"
+	return fmt.Sprintf("[%s, %s)", p.Start.Format(layout), p.End.Format(layout))
+}
+
+// MonthPeriods returns count consecutive month periods starting from the
+// given year and month.
+func MonthPeriods(year int, month time.Month, count int, loc *time.Location) []Period {
+	periods := make([]Period, 0, count)
+	start := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	for i := 0; i < count; i++ {
+		current := start.AddDate(0, i, 0)
+		periods = append(periods, MonthPeriod(current.Year(), current.Month(), loc))
+	}
+
+	return periods
+}
+
+// ParseYearMonth parses a month in the format YYYY-MM.
+func ParseYearMonth(value string) (int, time.Month, error) {
+	t, err := time.Parse("2006-01", strings.TrimSpace(value))
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to understand year and month, expected YYYY-MM: %v", value)
+	}
+
+	return t.Year(), t.Month(), nil
+}
+
+// MonthRangePeriods returns the month periods from and to the given months,
+// both in the format YYYY-MM and both inclusive.
+func MonthRangePeriods(from, to string, loc *time.Location) ([]Period, error) {
+	fromYear, fromMonth, err := ParseYearMonth(from)
+	if err != nil {
+		return nil, err
+	}
+	toYear, toMonth, err := ParseYearMonth(to)
+	if err != nil {
+		return nil, err
+	}
+
+	count := (toYear-fromYear)*12 + int(toMonth) - int(fromMonth) + 1
+	if count < 1 {
+		return nil, fmt.Errorf("from month is after to month: %v, %v", from, to)
+	}
+
+	return MonthPeriods(fromYear, fromMonth, count, loc), nil
+}
+
+// QuarterPeriods returns the month periods of a calendar quarter in the
+// format YYYY-QN, for example 2024-Q3 is July to September 2024.
+func QuarterPeriods(value string, loc *time.Location) ([]Period, error) {
+	parts := strings.Split(strings.ToUpper(strings.TrimSpace(value)), "-Q")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("unable to understand quarter, expected YYYY-QN: %v", value)
+	}
+	year, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to understand quarter, expected YYYY-QN: %v", value)
+	}
+	quarter, err := strconv.Atoi(parts[1])
+	if err != nil || quarter < 1 || quarter > 4 {
+		return nil, fmt.Errorf("quarter should be one of Q1, Q2, Q3, Q4: %v", value)
+	}
+
+	return MonthPeriods(year, time.Month((quarter-1)*3+1), 3, loc), nil
+}
+
+// FinancialYearPeriods returns the month periods of an Indian financial year
+// (April to March) in the format YYYY-YY or YYYY-YYYY, for example 2024-25
+// is April 2024 to March 2025.
+func FinancialYearPeriods(value string, loc *time.Location) ([]Period, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("unable to understand financial year, expected YYYY-YY: %v", value)
+	}
+	startYear, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts[0]) != 4 {
+		return nil, fmt.Errorf("unable to understand financial year, expected YYYY-YY: %v", value)
+	}
+	endYear, err := strconv.Atoi(parts[1])
+	if err != nil || (len(parts[1]) != 2 && len(parts[1]) != 4) {
+		return nil, fmt.Errorf("unable to understand financial year, expected YYYY-YY: %v", value)
+	}
+	if len(parts[1]) == 2 {
+		endYear += startYear - startYear%100
+		if endYear < startYear {
+			endYear += 100
+		}
+	}
+	if endYear != startYear+1 {
+		return nil, fmt.Errorf("financial year should span consecutive years: %v", value)
+	}
+
+	return MonthPeriods(startYear, time.April, 12, loc), nil
+}
+
+// MonthNameRangePeriods returns the month periods of the given year for a
+// range of case-insensitive month names such as jan-mar, or a single month.
+func MonthNameRangePeriods(value string, year int, loc *time.Location) ([]Period, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("unable to understand month range, expected month-month: %v", value)
+	}
+	from, err := GetMonthByName(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	to := from
+	if len(parts) == 2 {
+		if to, err = GetMonthByName(parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	if to < from {
+		return nil, fmt.Errorf("start month is after end month: %v", value)
+	}
+
+	return MonthPeriods(year, from, int(to-from)+1, loc), nil
+}
@@ -0,0 +1,189 @@
+package utils_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonthPeriod(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	assert.NoError(t, err)
+
+	params := []struct {
+		year          int
+		month         time.Month
+		loc           *time.Location
+		expectedStart time.Time
+		expectedEnd   time.Time
+	}{
+		{2022, time.April, time.UTC, time.Date(2022, time.April, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, time.May, 1, 0, 0, 0, 0, time.UTC)},
+		{2022, time.February, time.UTC, time.Date(2022, time.February, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{2020, time.February, kolkata, time.Date(2020, time.February, 1, 0, 0, 0, 0, kolkata), time.Date(2020, time.March, 1, 0, 0, 0, 0, kolkata)},
+		{2022, time.December, kolkata, time.Date(2022, time.December, 1, 0, 0, 0, 0, kolkata), time.Date(2023, time.January, 1, 0, 0, 0, 0, kolkata)},
+	}
+
+	for _, param := range params {
+		t.Run(fmt.Sprintf("Year=%d Month=%s Location=%s", param.year, param.month, param.loc), func(t *testing.T) {
+			actual := utils.MonthPeriod(param.year, param.month, param.loc)
+
+			assert.Equal(t, param.expectedStart, actual.Start)
+			assert.Equal(t, param.expectedEnd, actual.End)
+			assert.Equal(t, param.year, actual.Year())
+			assert.Equal(t, param.month, actual.Month())
+		})
+	}
+}
+
+func TestPeriodContains(t *testing.T) {
+	period := utils.MonthPeriod(2022, time.April, time.UTC)
+	params := []struct {
+		time     time.Time
+		expected bool
+	}{
+		{time.Date(2022, time.March, 31, 23, 59, 59, 0, time.UTC), false},
+		{time.Date(2022, time.April, 1, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2022, time.April, 30, 23, 59, 59, 0, time.UTC), true},
+		{time.Date(2022, time.May, 1, 0, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, param := range params {
+		t.Run(fmt.Sprintf("Time=%s", param.time), func(t *testing.T) {
+			assert.Equal(t, param.expected, period.Contains(param.time))
+		})
+	}
+}
+
+func TestPeriodAddMonths(t *testing.T) {
+	params := []struct {
+		months        int
+		expectedStart time.Time
+		expectedEnd   time.Time
+	}{
+		{0, time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC)},
+		{-1, time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{-4, time.Date(2023, time.December, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{1, time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, param := range params {
+		t.Run(fmt.Sprintf("Months=%d", param.months), func(t *testing.T) {
+			actual := utils.MonthPeriod(2024, time.April, time.UTC).AddMonths(param.months)
+
+			assert.Equal(t, param.expectedStart, actual.Start)
+			assert.Equal(t, param.expectedEnd, actual.End)
+		})
+	}
+}
+
+func months(periods []utils.Period) []string {
+	result := make([]string, 0, len(periods))
+	for _, period := range periods {
+		result = append(result, period.Start.Format("2006-01"))
+	}
+	return result
+}
+
+func TestMonthRangePeriods(t *testing.T) {
+	params := []struct {
+		from           string
+		to             string
+		expectedMonths []string
+		expectedErr    error
+	}{
+		{"2024-01", "2024-01", []string{"2024-01"}, nil},
+		{"2024-11", "2025-02", []string{"2024-11", "2024-12", "2025-01", "2025-02"}, nil},
+		{"2024-03", "2024-01", nil, fmt.Errorf("from month is after to month: 2024-03, 2024-01")},
+		{"2024/03", "2024-04", nil, fmt.Errorf("unable to understand year and month, expected YYYY-MM: 2024/03")},
+	}
+
+	for _, param := range params {
+		t.Run(fmt.Sprintf("From=%s To=%s", param.from, param.to), func(t *testing.T) {
+			periods, err := utils.MonthRangePeriods(param.from, param.to, time.UTC)
+
+			assert.Equal(t, param.expectedErr, err)
+			if param.expectedErr == nil {
+				assert.Equal(t, param.expectedMonths, months(periods))
+			}
+		})
+	}
+}
+
+func TestQuarterPeriods(t *testing.T) {
+	params := []struct {
+		quarter        string
+		expectedMonths []string
+		expectedErr    error
+	}{
+		{"2024-Q1", []string{"2024-01", "2024-02", "2024-03"}, nil},
+		{"2024-q3", []string{"2024-07", "2024-08", "2024-09"}, nil},
+		{"2024-Q5", nil, fmt.Errorf("quarter should be one of Q1, Q2, Q3, Q4: 2024-Q5")},
+		{"Q3-2024", nil, fmt.Errorf("unable to understand quarter, expected YYYY-QN: Q3-2024")},
+	}
+
+	for _, param := range params {
+		t.Run(fmt.Sprintf("Quarter=%s", param.quarter), func(t *testing.T) {
+			periods, err := utils.QuarterPeriods(param.quarter, time.UTC)
+
+			assert.Equal(t, param.expectedErr, err)
+			if param.expectedErr == nil {
+				assert.Equal(t, param.expectedMonths, months(periods))
+			}
+		})
+	}
+}
+
+func TestFinancialYearPeriods(t *testing.T) {
+	fy2024 := []string{"2024-04", "2024-05", "2024-06", "2024-07", "2024-08", "2024-09",
+		"2024-10", "2024-11", "2024-12", "2025-01", "2025-02", "2025-03"}
+	params := []struct {
+		financialYear  string
+		expectedMonths []string
+		expectedErr    error
+	}{
+		{"2024-25", fy2024, nil},
+		{"2024-2025", fy2024, nil},
+		{"2099-00", []string{"2099-04", "2099-05", "2099-06", "2099-07", "2099-08", "2099-09",
+			"2099-10", "2099-11", "2099-12", "2100-01", "2100-02", "2100-03"}, nil},
+		{"2024-26", nil, fmt.Errorf("financial year should span consecutive years: 2024-26")},
+		{"24-25", nil, fmt.Errorf("unable to understand financial year, expected YYYY-YY: 24-25")},
+	}
+
+	for _, param := range params {
+		t.Run(fmt.Sprintf("FinancialYear=%s", param.financialYear), func(t *testing.T) {
+			periods, err := utils.FinancialYearPeriods(param.financialYear, time.UTC)
+
+			assert.Equal(t, param.expectedErr, err)
+			if param.expectedErr == nil {
+				assert.Equal(t, param.expectedMonths, months(periods))
+			}
+		})
+	}
+}
+
+func TestMonthNameRangePeriods(t *testing.T) {
+	params := []struct {
+		months         string
+		expectedMonths []string
+		expectedErr    error
+	}{
+		{"jan-mar", []string{"2024-01", "2024-02", "2024-03"}, nil},
+		{"September", []string{"2024-09"}, nil},
+		{"mar-jan", nil, fmt.Errorf("start month is after end month: mar-jan")},
+		{"jan-xyz", nil, fmt.Errorf("unable to understand month: xyz")},
+	}
+
+	for _, param := range params {
+		t.Run(fmt.Sprintf("Months=%s", param.months), func(t *testing.T) {
+			periods, err := utils.MonthNameRangePeriods(param.months, 2024, time.UTC)
+
+			assert.Equal(t, param.expectedErr, err)
+			if param.expectedErr == nil {
+				assert.Equal(t, param.expectedMonths, months(periods))
+			}
+		})
+	}
+}
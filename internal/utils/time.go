@@ -24,12 +24,3 @@ func GetMonthByName(name string) (time.Month, error) {
 
 	return 0, fmt.Errorf("unable to understand month: %v", name)
 }
-
-func StartOfMonth(year int, month time.Month) time.Time {
-	return time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
-}
-
-func EndOfMonth(year int, month time.Month) time.Time {
-	temp := time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
-	return temp.AddDate(0, 1, -temp.Day())
-}
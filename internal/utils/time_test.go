@@ -31,42 +31,3 @@ func TestGetMonthByName(t *testing.T) {
 		})
 	}
 }
-
-func TestStartOfMonth(t *testing.T) {
-	params := []struct {
-		year     int
-		month    time.Month
-		expected time.Time
-	}{
-		{2022, time.March, time.Date(2022, time.March, 1, 0, 0, 0, 0, time.Local)},
-	}
-
-	for _, param := range params {
-		t.Run(fmt.Sprintf("Year=%d Month=%s", param.year, param.month), func(t *testing.T) {
-			actual := utils.StartOfMonth(param.year, param.month)
-
-			assert.Equal(t, param.expected, actual)
-		})
-	}
-}
-
-func TestEndOfMonth(t *testing.T) {
-	params := []struct {
-		year     int
-		month    time.Month
-		expected time.Time
-	}{
-		{2022, time.April, time.Date(2022, time.April, 30, 0, 0, 0, 0, time.Local)},
-		{2022, time.February, time.Date(2022, time.February, 28, 0, 0, 0, 0, time.Local)},
-		{2020, time.February, time.Date(2020, time.February, 29, 0, 0, 0, 0, time.Local)},
-		{2022, time.December, time.Date(2022, time.December, 31, 0, 0, 0, 0, time.Local)},
-	}
-
-	for _, param := range params {
-		t.Run(fmt.Sprintf("Year=%d Month=%s", param.year, param.month), func(t *testing.T) {
-			actual := utils.EndOfMonth(param.year, param.month)
-
-			assert.Equal(t, param.expected, actual)
-		})
-	}
-}
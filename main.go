@@ -2,32 +2,74 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"github.com/arunvelsriram/sodexwoe/internal/models"
 	"github.com/arunvelsriram/sodexwoe/internal/services"
 	"github.com/arunvelsriram/sodexwoe/internal/utils"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/api/gmail/v1"
 )
 
+// GoogleAPICredentials is the base64 encoded client_secret.json of the
+// built-in Google API client, set at build time.
 var GoogleAPICredentials string
 
+// tokenPassphraseEnv is the environment variable having the passphrase of the
+// encrypted token files.
+const tokenPassphraseEnv = "SODEXWOE_TOKEN_PASSPHRASE"
+
+// newGmailService creates the Gmail service, replaced by tests to use a fake
+// Gmail server.
+var newGmailService = services.NewGmailService
+
+// googleEndpoints are the Google API endpoints of the auth commands, replaced
+// by tests to use fake servers.
+var googleEndpoints services.GoogleEndpoints
+
 func main() {
 	cfg, err := config.LoadConfig()
+	app := newApp(cfg)
 	if err != nil {
-		log.Fatalf("unable to load configuration: %v", err)
+		// The config commands still run, so that config validate can report
+		// every problem of an invalid config.
+		before := app.Before
+		app.Before = func(ctx *cli.Context) error {
+			if ctx.Args().First() != "config" {
+				return fmt.Errorf("unable to load configuration: %v", err)
+			}
+			return before(ctx)
+		}
 	}
 
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newApp(cfg config.Config) *cli.App {
 	billNames := cfg.BillNames()
+	accountFlag := &cli.StringFlag{
+		Name:     "account",
+		Aliases:  []string{"a"},
+		Usage:    "Name of the Google account under accounts in the config, instead of the default account",
+		Required: false,
+	}
 
-	app := &cli.App{
+	return &cli.App{
 		Name:  "sodexwoe",
 		Usage: "Sodexo Woe!",
 		Flags: []cli.Flag{
@@ -39,6 +81,20 @@ func main() {
 				Required: false,
 				Value:    log.InfoLevel.String(),
 			},
+			&cli.BoolFlag{
+				Name:     "no-browser",
+				Usage:    "Sign in to Google without opening a browser, using a device code or by pasting the redirect URL, eg. over SSH",
+				EnvVars:  []string{"SODEXWOE_NO_BROWSER"},
+				Value:    false,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:      "credentials",
+				Usage:     "Path of the client_secret.json of a Google API client to use instead of the built-in one",
+				EnvVars:   []string{"SODEXWOE_CREDENTIALS"},
+				TakesFile: true,
+				Required:  false,
+			},
 		},
 		Before: func(ctx *cli.Context) error {
 			logLevel := ctx.String("log-level")
@@ -47,6 +103,9 @@ func main() {
 				return err
 			}
 			log.SetLevel(level)
+			if ctx.IsSet("credentials") {
+				cfg.CredentialsFile = ctx.String("credentials")
+			}
 
 			return nil
 		},
@@ -62,6 +121,102 @@ func main() {
 							return config.DumpConfig()
 						},
 					},
+					{
+						Name:      "validate",
+						Usage:     "Validate the config file, printing every problem along with its line",
+						ArgsUsage: "[config file, defaults to ~/" + constants.DEFAULT_CONFIG_FILE + "]",
+						Action: func(ctx *cli.Context) error {
+							configPath := ctx.Args().First()
+							if configPath == "" {
+								var err error
+								if configPath, err = config.ConfigPath(); err != nil {
+									return err
+								}
+							}
+
+							_, err := config.LoadConfigFile(configPath)
+							var problems config.Problems
+							if errors.As(err, &problems) {
+								for _, problem := range problems {
+									fmt.Fprintln(ctx.App.Writer, problem)
+								}
+								return fmt.Errorf("config has problems: %d, %v", len(problems), configPath)
+							}
+							if err != nil {
+								return err
+							}
+
+							fmt.Fprintf(ctx.App.Writer, "Config is valid: %v\n", configPath)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "Cache of emails and attachments fetched from Gmail",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "ls",
+						Usage: "List cached entries",
+						Flags: []cli.Flag{accountFlag},
+						Action: func(ctx *cli.Context) error {
+							cachePath, err := accountCachePath(cfg, ctx.String("account"))
+							if err != nil {
+								return err
+							}
+							entries, err := services.NewCacheService(cachePath).Entries()
+							if err != nil {
+								return err
+							}
+
+							w := tabwriter.NewWriter(ctx.App.Writer, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "KEY\tSIZE\tMODIFIED")
+							for _, entry := range entries {
+								fmt.Fprintf(w, "%s\t%d\t%s\n", entry.Key, entry.Size, entry.ModTime.Format(time.RFC3339))
+							}
+							w.Flush()
+							fmt.Fprintf(ctx.App.Writer, "Total: %d entries, %d bytes in %s\n", len(entries), entries.Size(), cachePath)
+							return nil
+						},
+					},
+					{
+						Name:  "prune",
+						Usage: "Remove cached entries older than the given duration and unreferenced attachments",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:     "older-than",
+								Usage:    "Age of the entries to remove, eg. 720h. Only unreferenced attachments are removed when not set",
+								Required: false,
+							},
+							accountFlag,
+						},
+						Action: func(ctx *cli.Context) error {
+							cachePath, err := accountCachePath(cfg, ctx.String("account"))
+							if err != nil {
+								return err
+							}
+							pruned, err := services.NewCacheService(cachePath).Prune(ctx.Duration("older-than"))
+							if err != nil {
+								return err
+							}
+
+							fmt.Fprintf(ctx.App.Writer, "Pruned: %d entries, %d bytes\n", len(pruned), pruned.Size())
+							return nil
+						},
+					},
+					{
+						Name:  "clear",
+						Usage: "Remove all cached entries",
+						Flags: []cli.Flag{accountFlag},
+						Action: func(ctx *cli.Context) error {
+							cachePath, err := accountCachePath(cfg, ctx.String("account"))
+							if err != nil {
+								return err
+							}
+							return services.NewCacheService(cachePath).Clear()
+						},
+					},
 				},
 			},
 			{
@@ -112,6 +267,43 @@ func main() {
 						Value:    time.Now().Local().Month().String(),
 						Required: false,
 					},
+					&cli.StringFlag{
+						Name:     "months",
+						Usage:    "Range of case-insensitive month names within --year, eg. jan-mar",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "from",
+						Usage:    "First month of the range in the format YYYY-MM, used along with --to",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "to",
+						Usage:    "Last month of the range in the format YYYY-MM, used along with --from",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "period",
+						Usage:    "Calendar quarter in the format YYYY-QN, eg. 2024-Q3",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "fy",
+						Usage:    "Financial year (April to March) in the format YYYY-YY, eg. 2024-25",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "offline",
+						Usage:    "Use only the emails and attachments cached by earlier runs, without connecting to Gmail",
+						Value:    false,
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "strict",
+						Usage:    "Fail on the first unexpected email or bill that cannot be converted instead of skipping it",
+						Value:    false,
+						Required: false,
+					},
 					&cli.StringSliceFlag{
 						Name:        "names",
 						Aliases:     []string{"n"},
@@ -123,48 +315,716 @@ func main() {
 				},
 				Action: func(ctx *cli.Context) error {
 					billNames := ctx.StringSlice("names")
-					year := ctx.Int("year")
-					monthFlagValue := ctx.String("month")
-					month, err := utils.GetMonthByName(monthFlagValue)
+					loc, err := cfg.Location()
+					if err != nil {
+						return err
+					}
+					periods, err := periodsFromFlags(ctx, loc)
 					if err != nil {
 						return err
 					}
 
-					gmailSrv, err := services.NewGmailService(GoogleAPICredentials)
+					offline := ctx.Bool("offline")
+					mailSrc, err := newMailSource(cfg, billNames, offline, ctx.Bool("no-browser"))
 					if err != nil {
 						return err
 					}
-					billEmailSrv := services.NewBillEmailService(gmailSrv, cfg)
+					defer closeMailSource(mailSrc)
+					billEmailSrv := services.NewBillEmailService(mailSrc, cfg)
 					billConverterSrv := services.NewBillConverterService(cfg)
+					billDedupeSrv, err := newBillDedupeService(cfg, billConverterSrv)
+					if err != nil {
+						return err
+					}
 
-					emails, err := billEmailSrv.GetEmails(billNames, year, month)
+					strict := ctx.Bool("strict")
+					emails := make(models.BillEmails, 0)
+					skipped := make(models.SkippedEmails, 0)
+					for _, period := range periods {
+						log.WithField("period", period).Info("downloading bills")
+						periodEmails, skippedEmails, err := billEmailSrv.GetEmails(billNames, period, strict)
+						if err != nil {
+							return err
+						}
+						emails = append(emails, periodEmails...)
+						skipped = append(skipped, skippedEmails...)
+					}
+
+					emails, duplicates, err := billDedupeSrv.Dedupe(emails)
+					if err != nil {
+						return err
+					}
+					skipped = append(skipped, duplicates...)
+
+					converted, skippedEmails, err := convertBills(cfg, billConverterSrv, emails, strict)
+					if err != nil {
+						return err
+					}
+					skipped = append(skipped, skippedEmails...)
+					if err := billDedupeSrv.Claim(converted); err != nil {
+						return err
+					}
+
+					if cfg.MarkProcessed() {
+						if offline {
+							log.Warn("not marking emails as processed when offline")
+						} else if err := billEmailSrv.MarkProcessed(converted); err != nil {
+							return err
+						}
+					}
+
+					printSummary(ctx.App.Writer, converted, skipped)
+
+					return nil
+				},
+			},
+			{
+				Name:  "sync",
+				Usage: "Download and convert bills received since the last sync",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:        "names",
+						Aliases:     []string{"n"},
+						Usage:       fmt.Sprintf("Comma separated bill names from: %v", strings.Join(billNames, ", ")),
+						Value:       cli.NewStringSlice(billNames...),
+						DefaultText: strings.Join(billNames, ","),
+						Required:    false,
+					},
+					&cli.BoolFlag{
+						Name:     "reset",
+						Usage:    "Sync from now on, without downloading bills received since the last sync",
+						Value:    false,
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "strict",
+						Usage:    "Fail on the first email or bill that cannot be converted instead of skipping it",
+						Value:    false,
+						Required: false,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					billNames := ctx.StringSlice("names")
+					strict := ctx.Bool("strict")
+
+					billNamesByAccount, err := cfg.BillNamesByAccount(billNames)
 					if err != nil {
 						return err
 					}
+					accounts := accountNames(billNamesByAccount)
+					if len(accounts) > 1 {
+						return fmt.Errorf("sync supports the bills of one account at a time, use --names to pick the bills of an account from: %v", strings.Join(accounts, ", "))
+					}
+					account := ""
+					if len(accounts) == 1 {
+						account = accounts[0]
+					}
+					syncStatePath, err := config.SyncStatePath(account)
+					if err != nil {
+						return err
+					}
+					syncStateSrv := services.NewSyncStateService(syncStatePath)
+					state, _, err := syncStateSrv.Load()
+					if err != nil {
+						return err
+					}
+					if ctx.Bool("reset") {
+						for _, billName := range billNames {
+							delete(state.HistoryIds, billName)
+						}
+					}
 
-					for _, email := range emails {
-						log.WithField("billName", email.BillName).WithField("filename", email.Bill.Filename).Info("converting file")
-						outputFilename := fmt.Sprintf("%s_%s_%d--%s", email.BillName, email.Month.String(), email.Year, filepath.Base(email.Bill.Filename))
-						output := filepath.Join(cfg.DownloadDir, email.BillName, outputFilename)
-						log.WithField("output", output).Info("creating output file")
-						outputFile, err := utils.CreateFile(output)
+					// Each bill is synced from its own history id, so that syncing
+					// some of the bills does not skip the new emails of the others.
+					startHistoryIds := make(map[string]uint64)
+					startedBillNames := make([]string, 0)
+					unsupportedBillNames := make([]string, 0)
+					for _, billName := range billNames {
+						billConfig, err := cfg.Bill(billName)
 						if err != nil {
 							return err
 						}
+						if !billConfig.IsLabelBased() {
+							unsupportedBillNames = append(unsupportedBillNames, billName)
+							continue
+						}
+						if historyId, ok := state.HistoryIds[billName]; ok {
+							startHistoryIds[billName] = historyId
+						} else {
+							startedBillNames = append(startedBillNames, billName)
+						}
+					}
+					if len(startHistoryIds) == 0 && len(startedBillNames) == 0 {
+						return fmt.Errorf("sync supports only label based bills, use bill-download for: %v", strings.Join(unsupportedBillNames, ", "))
+					}
 
-						err = billConverterSrv.Convert(email.BillName, bytes.NewReader(email.Bill.Data), outputFile)
+					mailSrc, err := newMailSource(cfg, billNames, false, ctx.Bool("no-browser"))
+					if err != nil {
+						return err
+					}
+					defer closeMailSource(mailSrc)
+					billEmailSrv := services.NewBillEmailService(mailSrc, cfg)
+					billConverterSrv := services.NewBillConverterService(cfg)
+					billDedupeSrv, err := newBillDedupeService(cfg, billConverterSrv)
+					if err != nil {
+						return err
+					}
+
+					if len(startedBillNames) > 0 {
+						historyId, err := billEmailSrv.GetHistoryId()
 						if err != nil {
 							return err
 						}
+						for _, billName := range startedBillNames {
+							state.HistoryIds[billName] = historyId
+						}
 					}
 
+					converted := make(models.BillEmails, 0)
+					skipped := make(models.SkippedEmails, 0)
+					if len(startHistoryIds) > 0 {
+						emails, skippedEmails, historyId, err := billEmailSrv.GetNewEmails(startHistoryIds, strict)
+						if errors.Is(err, services.ErrHistoryExpired) {
+							return fmt.Errorf("%w since the last sync at %s, use bill-download for the missed months and then sync --reset", err, state.SyncedAt.Format(time.RFC3339))
+						}
+						if err != nil {
+							return err
+						}
+						skipped = append(skipped, skippedEmails...)
+
+						emails, duplicates, err := billDedupeSrv.Dedupe(emails)
+						if err != nil {
+							return err
+						}
+						skipped = append(skipped, duplicates...)
+
+						convertedBills, skippedBills, err := convertBills(cfg, billConverterSrv, emails, strict)
+						if err != nil {
+							return err
+						}
+						converted = append(converted, convertedBills...)
+						skipped = append(skipped, skippedBills...)
+						if err := billDedupeSrv.Claim(converted); err != nil {
+							return err
+						}
+
+						if cfg.MarkProcessed() {
+							if err := billEmailSrv.MarkProcessed(converted); err != nil {
+								return err
+							}
+						}
+
+						for billName := range startHistoryIds {
+							state.HistoryIds[billName] = historyId
+						}
+					}
+
+					state.SyncedAt = time.Now()
+					if err := syncStateSrv.Save(state); err != nil {
+						return err
+					}
+					if len(startedBillNames) > 0 {
+						fmt.Fprintf(ctx.App.Writer, "Sync started for: %v, bills received from now on will be downloaded by the next sync. Use bill-download for the earlier bills.\n", strings.Join(startedBillNames, ", "))
+					}
+					if len(unsupportedBillNames) > 0 {
+						fmt.Fprintf(ctx.App.Writer, "Not synced as sync supports only label based bills, use bill-download for: %v\n", strings.Join(unsupportedBillNames, ", "))
+					}
+					if len(startHistoryIds) == 0 {
+						return nil
+					}
+					printSummary(ctx.App.Writer, converted, skipped)
+
 					return nil
 				},
 			},
+			{
+				Name:  "bills",
+				Usage: "Check the bills of a month",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "check",
+						Usage: "List the bills missing, duplicated or not converted yet for a month, failing when any are missing",
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:     "year",
+								Aliases:  []string{"y"},
+								Usage:    "Year",
+								Value:    time.Now().Local().Year(),
+								Required: false,
+							},
+							&cli.StringFlag{
+								Name:     "month",
+								Aliases:  []string{"m"},
+								Usage:    "Case-insensitive short or long month name",
+								Value:    time.Now().Local().Month().String(),
+								Required: false,
+							},
+							&cli.StringSliceFlag{
+								Name:        "names",
+								Aliases:     []string{"n"},
+								Usage:       fmt.Sprintf("Comma separated bill names from: %v", strings.Join(billNames, ", ")),
+								Value:       cli.NewStringSlice(billNames...),
+								DefaultText: strings.Join(billNames, ","),
+								Required:    false,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							month, err := utils.GetMonthByName(ctx.String("month"))
+							if err != nil {
+								return err
+							}
+
+							billNames := ctx.StringSlice("names")
+							mailSrc, err := newMailSource(cfg, billNames, false, ctx.Bool("no-browser"))
+							if err != nil {
+								return err
+							}
+							defer closeMailSource(mailSrc)
+							billCheckSrv := services.NewBillCheckService(services.NewBillEmailService(mailSrc, cfg), cfg)
+							checks, err := billCheckSrv.Check(billNames, ctx.Int("year"), month)
+							if err != nil {
+								return err
+							}
+
+							w := tabwriter.NewWriter(ctx.App.Writer, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "BILL NAME\tEMAILS\tFILES\tSTATUS")
+							for _, check := range checks {
+								fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", check.BillName, len(check.MessageIds), len(check.Files), check.Status())
+							}
+							w.Flush()
+
+							if missing := checks.Missing(); len(missing) > 0 {
+								return fmt.Errorf("missing bills for %s %d: %v", month, ctx.Int("year"), strings.Join(missing, ", "))
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "auth",
+				Usage: "Manage the Google sign in",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "login",
+						Usage: "Sign in to Google again, replacing the saved token",
+						Flags: []cli.Flag{accountFlag},
+						Action: func(ctx *cli.Context) error {
+							authSrv, err := newGoogleAuthService(cfg, ctx)
+							if err != nil {
+								return err
+							}
+							if err := authSrv.Login(gmailScope(cfg)); err != nil {
+								return err
+							}
+							status, err := authSrv.Status()
+							if err != nil {
+								return err
+							}
+
+							printAuthStatus(ctx.App.Writer, status)
+							return nil
+						},
+					},
+					{
+						Name:  "status",
+						Usage: "Show the signed in account along with the scopes and expiry of its token",
+						Flags: []cli.Flag{accountFlag},
+						Action: func(ctx *cli.Context) error {
+							authSrv, err := newGoogleAuthService(cfg, ctx)
+							if err != nil {
+								return err
+							}
+							status, err := authSrv.Status()
+							if err != nil {
+								return err
+							}
+
+							printAuthStatus(ctx.App.Writer, status)
+							return nil
+						},
+					},
+					{
+						Name:  "logout",
+						Usage: "Delete the saved token",
+						Flags: []cli.Flag{accountFlag},
+						Action: func(ctx *cli.Context) error {
+							authSrv, err := newGoogleAuthService(cfg, ctx)
+							if err != nil {
+								return err
+							}
+							if err := authSrv.Logout(); err != nil {
+								return err
+							}
+
+							fmt.Fprintln(ctx.App.Writer, "Signed out, the saved token was deleted.")
+							return nil
+						},
+					},
+					{
+						Name:  "revoke",
+						Usage: "Revoke the access granted to sodexwoe in the Google account and delete the saved token",
+						Flags: []cli.Flag{accountFlag},
+						Action: func(ctx *cli.Context) error {
+							authSrv, err := newGoogleAuthService(cfg, ctx)
+							if err != nil {
+								return err
+							}
+							if err := authSrv.Revoke(); err != nil {
+								return err
+							}
+
+							fmt.Fprintln(ctx.App.Writer, "Access revoked, the saved token was deleted.")
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "setup",
+				Usage: "Set up the mailbox for the configured bills",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "gmail",
+						Usage: "Create the labels of the bills and filters labelling new bill emails",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:        "names",
+								Aliases:     []string{"n"},
+								Usage:       fmt.Sprintf("Comma separated bill names from: %v", strings.Join(billNames, ", ")),
+								Value:       cli.NewStringSlice(billNames...),
+								DefaultText: strings.Join(billNames, ","),
+								Required:    false,
+							},
+							&cli.BoolFlag{
+								Name:     "back-apply",
+								Usage:    "Label the existing emails matching the sender/subject rules of the bills too",
+								Value:    false,
+								Required: false,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							billNamesByAccount, err := cfg.BillNamesByAccount(ctx.StringSlice("names"))
+							if err != nil {
+								return err
+							}
+
+							results := make(models.GmailSetupResults, 0)
+							for _, accountName := range accountNames(billNamesByAccount) {
+								account, err := googleAccount(cfg, accountName)
+								if err != nil {
+									return err
+								}
+								credentials, err := googleAPICredentials(cfg)
+								if err != nil {
+									return err
+								}
+								tokenStore, err := newTokenStore(cfg)
+								if err != nil {
+									return err
+								}
+								gmailSrv, err := newGmailService(credentials, tokenStore, account, ctx.Bool("no-browser"), gmail.GmailModifyScope, gmail.GmailSettingsBasicScope)
+								if err != nil {
+									return err
+								}
+
+								accountResults, err := services.NewGmailSetupService(gmailSrv, cfg).Setup(billNamesByAccount[accountName], ctx.Bool("back-apply"))
+								if err != nil {
+									return err
+								}
+								results = append(results, accountResults...)
+							}
+
+							w := tabwriter.NewWriter(ctx.App.Writer, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "BILL NAME\tLABEL\tLABEL CREATED\tFILTER CREATED\tLABELLED EMAILS\tNOTE")
+							for _, result := range results {
+								fmt.Fprintf(w, "%s\t%s\t%t\t%t\t%d\t%s\n", result.BillName, result.Label, result.LabelCreated, result.FilterCreated, result.LabelledEmails, result.Note)
+							}
+							w.Flush()
+
+							return nil
+						},
+					},
+				},
+			},
 		},
 	}
+}
+
+// newMailSource creates the configured mail source. Offline, Gmail emails are
+// read only from the cache. Local mail exports are always read offline.
+func newMailSource(cfg config.Config, billNames []string, offline, noBrowser bool) (services.MailSource, error) {
+	switch cfg.MailSource() {
+	case constants.SOURCE_GMAIL:
+		billNamesByAccount, err := cfg.BillNamesByAccount(billNames)
+		if err != nil {
+			return nil, err
+		}
+		if len(billNamesByAccount) == 0 {
+			billNamesByAccount[""] = billNames
+		}
+
+		sources := make(map[string]services.MailSource, len(billNamesByAccount))
+		for _, accountName := range accountNames(billNamesByAccount) {
+			cachePath, err := config.CachePath(accountName)
+			if err != nil {
+				return nil, err
+			}
+			var gmailSrv *gmail.Service
+			if !offline {
+				account, err := googleAccount(cfg, accountName)
+				if err != nil {
+					return nil, err
+				}
+				credentials, err := googleAPICredentials(cfg)
+				if err != nil {
+					return nil, err
+				}
+				tokenStore, err := newTokenStore(cfg)
+				if err != nil {
+					return nil, err
+				}
+				if gmailSrv, err = newGmailService(credentials, tokenStore, account, noBrowser, gmailScope(cfg)); err != nil {
+					return nil, err
+				}
+			}
+			sources[accountName] = services.NewGmailMailSource(gmailSrv, services.NewCacheService(cachePath), cfg)
+		}
+		if len(sources) == 1 {
+			for _, source := range sources {
+				return source, nil
+			}
+		}
+		return services.NewAccountsMailSource(sources, cfg), nil
+	case constants.SOURCE_IMAP:
+		if offline {
+			return nil, errors.New("--offline is supported only with gmail")
+		}
+		return services.NewIMAPMailSource(cfg), nil
+	case constants.SOURCE_EML, constants.SOURCE_MBOX, constants.SOURCE_MAILDIR:
+		if cfg.Local.Path == "" {
+			return nil, fmt.Errorf("local path is not configured for mail source: %v", cfg.MailSource())
+		}
+		return services.NewLocalMailSource(cfg.MailSource(), cfg.Local.Path, cfg), nil
+	case constants.SOURCE_OUTLOOK:
+		if offline {
+			return nil, errors.New("--offline is supported only with gmail")
+		}
+		tokenStore, err := newTokenStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		httpClient, err := services.NewOutlookClient(cfg.Outlook, tokenStore)
+		if err != nil {
+			return nil, err
+		}
+		return services.NewGraphMailSource(httpClient, constants.GRAPH_API_URL, cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown mail source: %v", cfg.Source)
+	}
+}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+func newBillDedupeService(cfg config.Config, billConverterSrv services.BillConverterService) (services.BillDedupeService, error) {
+	claimedBillsPath, err := config.ClaimedBillsPath()
+	if err != nil {
+		return nil, err
+	}
+	return services.NewBillDedupeService(billConverterSrv, cfg, claimedBillsPath), nil
+}
+
+// googleAccount returns the Google account of the account name, which is
+// empty for the default account.
+func googleAccount(cfg config.Config, name string) (services.GoogleAccount, error) {
+	account, err := cfg.Account(name)
+	if err != nil {
+		return services.GoogleAccount{}, err
+	}
+	return services.GoogleAccount{Name: name, Email: account.Email}, nil
+}
+
+// accountCachePath returns the cache directory of the Google account chosen
+// using the --account flag.
+func accountCachePath(cfg config.Config, name string) (string, error) {
+	if _, err := cfg.Account(name); err != nil {
+		return "", err
+	}
+	return config.CachePath(name)
+}
+
+// newGoogleAuthService creates the auth service of the Google account chosen
+// using the --account flag.
+func newGoogleAuthService(cfg config.Config, ctx *cli.Context) (services.GoogleAuthService, error) {
+	account, err := googleAccount(cfg, ctx.String("account"))
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := googleAPICredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tokenStore, err := newTokenStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return services.NewGoogleAuthService(credentials, tokenStore, account, ctx.Bool("no-browser"), googleEndpoints), nil
+}
+
+// newTokenStore creates the configured token store, reading the passphrase of
+// the encrypted token files from the environment.
+func newTokenStore(cfg config.Config) (services.TokenStore, error) {
+	passphrase := os.Getenv(tokenPassphraseEnv)
+	if cfg.TokenStoreKind() == constants.TOKEN_STORE_ENCRYPTED_FILE && passphrase == "" {
+		return nil, fmt.Errorf("%v is not set, the passphrase is needed to encrypt the token files", tokenPassphraseEnv)
+	}
+	return services.NewTokenStore(cfg.TokenStoreKind(), passphrase)
+}
+
+// googleAPICredentials returns the client_secret.json of the Google API client
+// from the credentials file, falling back to the built-in credentials.
+func googleAPICredentials(cfg config.Config) ([]byte, error) {
+	if cfg.CredentialsFile != "" {
+		credentials, err := os.ReadFile(cfg.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credentials file: %v", err)
+		}
+		return credentials, nil
+	}
+	if GoogleAPICredentials == "" {
+		return nil, errors.New("no built-in Google API credentials, use --credentials or credentials_file to set the client_secret.json of a Google API client")
+	}
+
+	credentials, err := base64.StdEncoding.DecodeString(GoogleAPICredentials)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode built-in Google API credentials: %v", err)
+	}
+	return credentials, nil
+}
+
+// accountNames returns the account names of the grouped bill names, sorted.
+func accountNames(billNamesByAccount map[string][]string) []string {
+	names := make([]string, 0, len(billNamesByAccount))
+	for name := range billNamesByAccount {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gmailScope returns the scope needed to read bills, which includes modifying
+// emails when they are marked as processed.
+func gmailScope(cfg config.Config) string {
+	if cfg.MarkProcessed() {
+		return gmail.GmailModifyScope
+	}
+	return gmail.GmailReadonlyScope
+}
+
+func closeMailSource(mailSrc services.MailSource) {
+	if closer, ok := mailSrc.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// convertBills converts the bills and writes them under the download dir, one
+// directory per month. Unless strict is set, bills that fail to convert are
+// skipped and reported instead of failing.
+func convertBills(cfg config.Config, billConverterSrv services.BillConverterService, emails models.BillEmails, strict bool) (models.BillEmails, models.SkippedEmails, error) {
+	converted := make(models.BillEmails, 0, len(emails))
+	skipped := make(models.SkippedEmails, 0)
+	for _, email := range emails {
+		log.WithField("billName", email.BillName).WithField("filename", email.Bill.Filename).Info("converting file")
+		output := email.OutputPath(cfg.DownloadDir)
+		log.WithField("output", output).Info("creating output file")
+		outputFile, err := utils.CreateFile(output)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = billConverterSrv.Convert(email.BillName, bytes.NewReader(email.Bill.Data), outputFile)
+		if closeErr := outputFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			if strict {
+				return nil, nil, err
+			}
+			log.WithField("messageId", email.MessageId).WithField("reason", err).Warn("skipping email")
+			skipped = append(skipped, models.SkippedEmail{MessageId: email.MessageId, BillName: email.BillName, Reason: fmt.Sprintf("failed to convert bill: %v", err)})
+			if err := os.Remove(output); err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+		converted = append(converted, email)
+	}
+
+	return converted, skipped, nil
+}
+
+// periodsFromFlags returns the months selected using one of --months, --from
+// and --to, --period, --fy, or --month, along with --year where applicable.
+func periodsFromFlags(ctx *cli.Context, loc *time.Location) ([]utils.Period, error) {
+	selected := make([]string, 0, 4)
+	for _, name := range []string{"month", "months", "from", "period", "fy"} {
+		if ctx.IsSet(name) {
+			selected = append(selected, "--"+name)
+		}
+	}
+	if len(selected) > 1 {
+		return nil, fmt.Errorf("only one of --month, --months, --from/--to, --period, --fy can be used: %v", strings.Join(selected, ", "))
+	}
+	if ctx.IsSet("from") != ctx.IsSet("to") {
+		return nil, errors.New("--from and --to should be used together")
+	}
+	if (ctx.IsSet("period") || ctx.IsSet("fy") || ctx.IsSet("from")) && ctx.IsSet("year") {
+		return nil, errors.New("--year can be used only with --month or --months")
+	}
+
+	year := ctx.Int("year")
+	switch {
+	case ctx.IsSet("months"):
+		return utils.MonthNameRangePeriods(ctx.String("months"), year, loc)
+	case ctx.IsSet("from"):
+		return utils.MonthRangePeriods(ctx.String("from"), ctx.String("to"), loc)
+	case ctx.IsSet("period"):
+		return utils.QuarterPeriods(ctx.String("period"), loc)
+	case ctx.IsSet("fy"):
+		return utils.FinancialYearPeriods(ctx.String("fy"), loc)
+	default:
+		month, err := utils.GetMonthByName(ctx.String("month"))
+		if err != nil {
+			return nil, err
+		}
+		return []utils.Period{utils.MonthPeriod(year, month, loc)}, nil
+	}
+}
+
+func printSummary(out io.Writer, converted models.BillEmails, skipped models.SkippedEmails) {
+	fmt.Fprintf(out, "Converted bills: %d\n", len(converted))
+	fmt.Fprintf(out, "Skipped emails: %d\n", len(skipped))
+	if len(skipped) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MESSAGE ID\tBILL NAME\tREASON")
+	for _, email := range skipped {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", email.MessageId, email.BillName, email.Reason)
+	}
+	w.Flush()
+}
+
+func printAuthStatus(out io.Writer, status models.AuthStatus) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Account:\t%s\n", status.Email)
+	scopes := "unknown"
+	if len(status.Scopes) > 0 {
+		scopes = strings.Join(status.Scopes, " ")
 	}
+	fmt.Fprintf(w, "Scopes:\t%s\n", scopes)
+	fmt.Fprintf(w, "Token expiry:\t%s\n", status.Expiry.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "Token location:\t%s\n", status.TokenLocation)
+	w.Flush()
 }
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arunvelsriram/sodexwoe/internal/config"
+	"github.com/arunvelsriram/sodexwoe/internal/constants"
+	"github.com/arunvelsriram/sodexwoe/internal/services"
+	"github.com/arunvelsriram/sodexwoe/internal/testutils"
+	"github.com/mitchellh/go-homedir"
+	pdfcpuapi "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// setup points the home directory to a temporary directory and the Gmail
+// service to a fake Gmail server having bills for March and April 2024.
+func setup(t *testing.T) (config.Config, *testutils.GmailServer) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+
+	server := testutils.NewGmailServer(t)
+	server.PageSize = 2
+	original := newGmailService
+	newGmailService = func([]byte, services.TokenStore, services.GoogleAccount, bool, ...string) (*gmail.Service, error) {
+		return server.Service(t), nil
+	}
+	t.Cleanup(func() { newGmailService = original })
+
+	for _, month := range []time.Month{time.March, time.April} {
+		received := time.Date(2024, month, 5, 10, 0, 0, 0, time.UTC)
+		name := month.String()
+		server.AddMessage(testutils.GmailMessage{
+			Id:          "airtel-" + name,
+			From:        "Airtel <ebill@airtel.com>",
+			Subject:     "Your Airtel bill",
+			Received:    received,
+			Attachments: []testutils.GmailAttachment{{Filename: "airtel.pdf", Data: testutils.BillPDF(t, "Airtel "+name, 4, "airtel")}},
+		}, "Postpaid Bills/Airtel")
+		server.AddMessage(testutils.GmailMessage{
+			Id:       "act-" + name,
+			From:     "ebill@actcorp.in",
+			Subject:  "Your ACT Fibernet bill",
+			Received: received.Add(time.Hour),
+			Attachments: []testutils.GmailAttachment{
+				{Filename: "logo.png", MimeType: "image/png", Data: []byte("png")},
+				{Filename: "act.pdf", Data: testutils.BillPDF(t, "ACT "+name, 3, "act")},
+			},
+		}, "Postpaid Bills/ACT")
+	}
+	server.AddMessage(testutils.GmailMessage{
+		Id:       "act-reminder",
+		From:     "ebill@actcorp.in",
+		Subject:  "Your ACT Fibernet bill is due",
+		Received: time.Date(2024, time.April, 20, 10, 0, 0, 0, time.UTC),
+	})
+	server.AddMessage(testutils.GmailMessage{
+		Id:          "jio-April",
+		From:        "jio@jio.com",
+		Subject:     "Your Jio bill",
+		Received:    time.Date(2024, time.April, 7, 10, 0, 0, 0, time.UTC),
+		Attachments: []testutils.GmailAttachment{{Filename: "jio.pdf", Data: testutils.BillPDF(t, "Jio April", 2, "old-password")}},
+	}, "Postpaid Bills/Jio")
+
+	credentialsFile := filepath.Join(home, "client_secret.json")
+	require.NoError(t, os.WriteFile(credentialsFile, []byte(`{"installed":{"client_id":"sodexwoe","redirect_uris":["http://localhost"]}}`), 0600))
+
+	cfg := config.Config{
+		CredentialsFile: credentialsFile,
+		DownloadDir:     filepath.Join(home, "Downloads", "sodexwoe"),
+		Timezone:        "Asia/Kolkata",
+		ProcessedLabel:  "sodexwoe/processed",
+		BillConfigs: config.BillConfigs{
+			"personal": {Label: "Postpaid Bills/Airtel", Password: "airtel", KeepPages: 2, PeriodOffset: -1},
+			"work":     {Label: "Postpaid Bills/Jio", Password: "jio", KeepPages: 1, AdditionalText: "GST Number: ABC123"},
+			"broadband": {
+				Password:      "act",
+				KeepPages:     1,
+				From:          "ebill@actcorp.in",
+				Subject:       "ACT Fibernet",
+				HasAttachment: true,
+			},
+		},
+	}
+	return cfg, server
+}
+
+func run(t *testing.T, cfg config.Config, args ...string) string {
+	var out bytes.Buffer
+	app := newApp(cfg)
+	app.Writer = &out
+	require.NoError(t, app.Run(append([]string{"sodexwoe"}, args...)))
+
+	return out.String()
+}
+
+// downloads describes the converted bills in the download dir along with
+// their page count, failing when any of them is still encrypted.
+func downloads(t *testing.T, cfg config.Config) string {
+	var out bytes.Buffer
+	err := filepath.WalkDir(cfg.DownloadDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(cfg.DownloadDir, path)
+		if err != nil {
+			return err
+		}
+		pages, err := pdfcpuapi.PageCountFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to read converted bill: %v: %v", rel, err)
+		}
+		fmt.Fprintf(&out, "%s pages=%d\n", filepath.ToSlash(rel), pages)
+		return nil
+	})
+	require.NoError(t, err)
+
+	return out.String()
+}
+
+func assertGolden(t *testing.T, name, actual string) {
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		require.NoError(t, os.MkdirAll("testdata", 0755))
+		require.NoError(t, os.WriteFile(golden, []byte(actual), 0644))
+	}
+	expected, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), actual)
+}
+
+func TestBillDownload(t *testing.T) {
+	cfg, server := setup(t)
+
+	out := run(t, cfg, "bill-download", "--from", "2024-03", "--to", "2024-04")
+
+	assertGolden(t, "bill-download", out+"\n"+downloads(t, cfg))
+	assert.Contains(t, server.LabelNames("airtel-April"), "sodexwoe/processed")
+	assert.NotContains(t, server.LabelNames("jio-April"), "sodexwoe/processed")
+}
+
+func TestBillDownloadCredentials(t *testing.T) {
+	cfg, server := setup(t)
+	credentialsFile := filepath.Join(t.TempDir(), "team_client_secret.json")
+	require.NoError(t, os.WriteFile(credentialsFile, []byte(`{"installed":{"client_id":"team"}}`), 0600))
+	var credentials []string
+	newGmailService = func(c []byte, _ services.TokenStore, _ services.GoogleAccount, _ bool, _ ...string) (*gmail.Service, error) {
+		credentials = append(credentials, string(c))
+		return server.Service(t), nil
+	}
+
+	run(t, cfg, "bill-download", "--from", "2024-04", "--to", "2024-04")
+	run(t, cfg, "--credentials", credentialsFile, "bill-download", "--from", "2024-04", "--to", "2024-04")
+
+	assert.Equal(t, []string{`{"installed":{"client_id":"sodexwoe","redirect_uris":["http://localhost"]}}`, `{"installed":{"client_id":"team"}}`}, credentials)
+}
+
+func TestBillDownloadOffline(t *testing.T) {
+	cfg, server := setup(t)
+	cfg.ProcessedLabel = ""
+	run(t, cfg, "bill-download", "--from", "2024-03", "--to", "2024-04")
+	require.NoError(t, os.RemoveAll(cfg.DownloadDir))
+	server.Close()
+
+	out := run(t, cfg, "bill-download", "--from", "2024-03", "--to", "2024-04", "--offline")
+
+	assertGolden(t, "bill-download", out+"\n"+downloads(t, cfg))
+}
+
+func TestBillDownloadIMAPProcessedLabel(t *testing.T) {
+	cfg, _ := setup(t)
+	received := time.Date(2024, time.April, 5, 10, 0, 0, 0, time.UTC)
+	cfg.Source = constants.SOURCE_IMAP
+	cfg.IMAP = config.IMAPConfig{
+		Address: testutils.StartIMAPServer(t, map[string]map[time.Time][]byte{
+			"Bills/Airtel": {received: testutils.Email(received, "ebill@airtel.com", "Your Airtel bill", "airtel.pdf", testutils.BillPDF(t, "Airtel April", 3, "airtel"))},
+		}),
+		Username:  "username",
+		Password:  "password",
+		Plaintext: true,
+	}
+	personal := cfg.BillConfigs["personal"]
+	personal.Folder = "Bills/Airtel"
+	cfg.BillConfigs = config.BillConfigs{"personal": personal}
+
+	out := run(t, cfg, "bill-download", "--from", "2024-03", "--to", "2024-03")
+
+	assert.Equal(t, "Converted bills: 1\nSkipped emails: 0\n", out)
+	assert.Equal(t, "2024-03/personal/personal_March_2024--airtel.pdf pages=2\n", downloads(t, cfg))
+}
+
+func TestBillDownloadAccounts(t *testing.T) {
+	cfg, server := setup(t)
+	officeServer := testutils.NewGmailServer(t)
+	officeServer.AddMessage(testutils.GmailMessage{
+		Id:          "jio-April",
+		From:        "jio@jio.com",
+		Subject:     "Your Jio bill",
+		Received:    time.Date(2024, time.April, 7, 10, 0, 0, 0, time.UTC),
+		Attachments: []testutils.GmailAttachment{{Filename: "jio.pdf", Data: testutils.BillPDF(t, "Jio April", 2, "old-password")}},
+	}, "Postpaid Bills/Jio")
+	server.RemoveMessage("jio-April")
+	accounts := make([]services.GoogleAccount, 0)
+	newGmailService = func(_ []byte, _ services.TokenStore, account services.GoogleAccount, _ bool, _ ...string) (*gmail.Service, error) {
+		accounts = append(accounts, account)
+		if account.Name == "office" {
+			return officeServer.Service(t), nil
+		}
+		return server.Service(t), nil
+	}
+	cfg.Accounts = config.Accounts{"office": {Email: "me@office.com"}}
+	work := cfg.BillConfigs["work"]
+	work.Account = "office"
+	cfg.BillConfigs["work"] = work
+
+	out := run(t, cfg, "bill-download", "--from", "2024-03", "--to", "2024-04")
+	defaultCache := run(t, cfg, "cache", "ls")
+	officeCache := run(t, cfg, "cache", "ls", "--account", "office")
+	run(t, cfg, "cache", "clear")
+	clearedOfficeCache := run(t, cfg, "cache", "ls", "--account", "office")
+
+	assertGolden(t, "bill-download", out+"\n"+downloads(t, cfg))
+	assert.Equal(t, []services.GoogleAccount{{}, {Name: "office", Email: "me@office.com"}}, accounts)
+	assert.Contains(t, server.LabelNames("airtel-April"), "sodexwoe/processed")
+	assert.NotContains(t, officeServer.LabelNames("jio-April"), "sodexwoe/processed")
+	assert.Contains(t, defaultCache, "messages/airtel-April")
+	assert.NotContains(t, defaultCache, "messages/jio-April")
+	assert.Contains(t, officeCache, "messages/jio-April")
+	assert.NotContains(t, officeCache, "messages/airtel-April")
+	assert.Equal(t, officeCache, clearedOfficeCache)
+}
+
+func TestSync(t *testing.T) {
+	cfg, server := setup(t)
+
+	first := run(t, cfg, "sync")
+	server.AddMessage(testutils.GmailMessage{
+		Id:          "airtel-May",
+		From:        "Airtel <ebill@airtel.com>",
+		Subject:     "Your Airtel bill",
+		Received:    time.Date(2024, time.May, 5, 10, 0, 0, 0, time.UTC),
+		Attachments: []testutils.GmailAttachment{{Filename: "airtel.pdf", Data: testutils.BillPDF(t, "Airtel May", 3, "airtel")}},
+	}, "Postpaid Bills/Airtel")
+	server.AddMessage(testutils.GmailMessage{
+		Id:          "jio-May",
+		From:        "jio@jio.com",
+		Subject:     "Your Jio bill",
+		Received:    time.Date(2024, time.May, 7, 10, 0, 0, 0, time.UTC),
+		Attachments: []testutils.GmailAttachment{{Filename: "jio.pdf", Data: testutils.BillPDF(t, "Jio May", 2, "jio")}},
+	}, "Postpaid Bills/Jio")
+	second := run(t, cfg, "sync", "--names", "personal")
+	third := run(t, cfg, "sync", "--names", "work")
+	fourth := run(t, cfg, "sync")
+
+	assertGolden(t, "sync", first+"\n"+second+"\n"+third+"\n"+fourth+"\n"+downloads(t, cfg))
+}
+
+func TestBillsCheck(t *testing.T) {
+	cfg, _ := setup(t)
+	run(t, cfg, "bill-download", "--from", "2024-03", "--to", "2024-04")
+
+	march := run(t, cfg, "bills", "check", "--year", "2024", "--month", "march", "--names", "personal,broadband")
+	var out bytes.Buffer
+	app := newApp(cfg)
+	app.Writer = &out
+	err := app.Run([]string{"sodexwoe", "bills", "check", "--year", "2024", "--month", "april"})
+
+	assert.Equal(t, "BILL NAME  EMAILS  FILES  STATUS\npersonal   1       1      ok\nbroadband  1       1      ok\n", march)
+	assert.EqualError(t, err, "missing bills for April 2024: personal")
+	assert.Equal(t, "BILL NAME  EMAILS  FILES  STATUS\nbroadband  1       1      ok\npersonal   0       0      missing\nwork       1       0      unconverted\n", out.String())
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg, _ := setup(t)
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("download_dir: ~/Downloads/sodexwoe\nbills:\n  personal:\n    typ: airtel_postpaid\n    label: Postpaid Bills/Airtel\n"), 0644))
+
+	valid := run(t, cfg, "config", "validate", "config.sample.yaml")
+	var out bytes.Buffer
+	app := newApp(cfg)
+	app.Writer = &out
+	err := app.Run([]string{"sodexwoe", "config", "validate", configPath})
+
+	assert.Equal(t, "Config is valid: config.sample.yaml\n", valid)
+	assert.EqualError(t, err, "config has problems: 2, "+configPath)
+	assert.Equal(t, "line 3: bills.personal.type is required\nline 4: unknown key: typ\n", out.String())
+}
+
+func TestCache(t *testing.T) {
+	cfg, _ := setup(t)
+	run(t, cfg, "bill-download", "--from", "2024-03", "--to", "2024-03", "--names", "personal")
+	cachePath, err := config.CachePath("")
+	require.NoError(t, err)
+	modTime := time.Date(2024, time.May, 1, 10, 0, 0, 0, time.UTC)
+	err = filepath.WalkDir(cachePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		return os.Chtimes(path, modTime, modTime)
+	})
+	require.NoError(t, err)
+
+	ls := run(t, cfg, "cache", "ls")
+	prune := run(t, cfg, "cache", "prune", "--older-than", "720h")
+	run(t, cfg, "cache", "clear")
+	cleared := run(t, cfg, "cache", "ls")
+
+	// The encrypted test bills, and so the hashes of the cached attachments,
+	// differ between runs.
+	out := regexp.MustCompile(`attachments/[0-9a-f]{64}`).ReplaceAllString(ls+"\n"+prune+"\n"+cleared, "attachments/<hash>")
+	out = strings.ReplaceAll(out, cachePath, "<cache>")
+	assertGolden(t, "cache", strings.ReplaceAll(out, modTime.Local().Format(time.RFC3339), modTime.Format(time.RFC3339)))
+}
+
+// signedIn saves a token of the default account valid until the expiry, and
+// points the auth commands to the fake Gmail server and a fake revocation
+// endpoint, which records the revoked tokens.
+func signedIn(t *testing.T, server *testutils.GmailServer, expiry time.Time, revokeStatus int) (string, *[]string) {
+	home, err := homedir.Dir()
+	require.NoError(t, err)
+	tokenFile := filepath.Join(home, constants.GOOGLE_TOKEN_FILE)
+	require.NoError(t, os.MkdirAll(filepath.Dir(tokenFile), 0755))
+	token := fmt.Sprintf(`{"access_token":"access","token_type":"Bearer","refresh_token":"refresh","expiry":%q,"scopes":[%q]}`, expiry.Format(time.RFC3339), gmail.GmailReadonlyScope)
+	require.NoError(t, os.WriteFile(tokenFile, []byte(token), 0600))
+
+	revoked := make([]string, 0)
+	revokeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revoked = append(revoked, r.FormValue("token"))
+		w.WriteHeader(revokeStatus)
+		if revokeStatus == http.StatusBadRequest {
+			w.Write([]byte(`{"error":"invalid_token"}`))
+		}
+	}))
+	t.Cleanup(revokeServer.Close)
+	original := googleEndpoints
+	googleEndpoints = services.GoogleEndpoints{Gmail: server.URL, Revoke: revokeServer.URL}
+	t.Cleanup(func() { googleEndpoints = original })
+
+	return tokenFile, &revoked
+}
+
+func TestAuthStatus(t *testing.T) {
+	cfg, server := setup(t)
+	expiry := time.Date(2099, time.January, 1, 10, 0, 0, 0, time.UTC)
+	tokenFile, _ := signedIn(t, server, expiry, http.StatusOK)
+
+	out := run(t, cfg, "auth", "status")
+
+	assert.Equal(t, fmt.Sprintf("Account:         me@example.com\nScopes:          %v\nToken expiry:    %v\nToken location:  %v\n", gmail.GmailReadonlyScope, expiry.Local().Format(time.RFC3339), tokenFile), out)
+}
+
+func TestAuthLogout(t *testing.T) {
+	cfg, server := setup(t)
+	tokenFile, revoked := signedIn(t, server, time.Now().Add(time.Hour), http.StatusOK)
+
+	out := run(t, cfg, "auth", "logout")
+	err := newApp(cfg).Run([]string{"sodexwoe", "auth", "status"})
+
+	assert.Equal(t, "Signed out, the saved token was deleted.\n", out)
+	assert.NoFileExists(t, tokenFile)
+	assert.Empty(t, *revoked)
+	assert.ErrorIs(t, err, services.ErrNotSignedIn)
+	assert.ErrorIs(t, newApp(cfg).Run([]string{"sodexwoe", "auth", "logout"}), services.ErrNotSignedIn)
+}
+
+func TestAuthRevoke(t *testing.T) {
+	params := []struct {
+		name   string
+		status int
+	}{
+		{"Revoked", http.StatusOK},
+		{"AlreadyRevoked", http.StatusBadRequest},
+	}
+
+	for _, param := range params {
+		t.Run(param.name, func(t *testing.T) {
+			cfg, server := setup(t)
+			tokenFile, revoked := signedIn(t, server, time.Now().Add(time.Hour), param.status)
+
+			out := run(t, cfg, "auth", "revoke")
+
+			assert.Equal(t, "Access revoked, the saved token was deleted.\n", out)
+			assert.Equal(t, []string{"refresh"}, *revoked)
+			assert.NoFileExists(t, tokenFile)
+		})
+	}
+}
+
+func TestAuthRevokeFailure(t *testing.T) {
+	cfg, server := setup(t)
+	tokenFile, _ := signedIn(t, server, time.Now().Add(time.Hour), http.StatusServiceUnavailable)
+
+	err := newApp(cfg).Run([]string{"sodexwoe", "auth", "revoke"})
+
+	assert.EqualError(t, err, "unable to revoke token: 503 Service Unavailable")
+	assert.FileExists(t, tokenFile)
+}